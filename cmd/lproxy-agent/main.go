@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"lproxy/xport/agent"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	cfg := agent.Config{Arch: runtime.GOARCH}
+
+	var ports, lanHosts string
+	flag.StringVar(&cfg.ServerURL, "s", "", "lproxy server base url, e.g. https://example.com:8000")
+	flag.StringVar(&cfg.UUID, "u", "", "device uuid")
+	flag.StringVar(&cfg.Version, "ver", "0.1.0", "device version reported to server")
+	flag.StringVar(&cfg.AuthPath, "auth", "/auth", "auth path")
+	flag.StringVar(&cfg.CfgMonitorPath, "cfgmonitor", "/cfgmonitor", "cfg monitor path")
+	flag.StringVar(&cfg.XPortLWSPath, "lws", "/xportlws", "xport lws path")
+	flag.IntVar(&cfg.Cap, "cap", 128, "max requests count")
+	flag.IntVar(&cfg.Quota, "quota", 256*1024, "flow control quota of each request, 0 means disable")
+	flag.StringVar(&ports, "p", "", "local ports that server may dial, comma separated, empty means any")
+	flag.StringVar(&lanHosts, "lan", "", "LAN hosts that server may dial, ip, cidr, hostname or *.suffix, comma separated")
+	flag.BoolVar(&cfg.InsecureSkipVerify, "k", false, "skip verify server certificate")
+	ping := flag.Int("ping", 30, "ping interval in seconds")
+	poll := flag.Int("poll", 600, "cfg poll interval in seconds")
+
+	flag.Parse()
+
+	if cfg.ServerURL == "" || cfg.UUID == "" {
+		log.Fatal("please specify server url and device uuid")
+	}
+
+	for _, s := range strings.Split(ports, ",") {
+		if s == "" {
+			continue
+		}
+
+		p, err := strconv.Atoi(s)
+		if err != nil || p <= 0 || p > 65535 {
+			log.Fatal("invalid port:", s)
+		}
+
+		cfg.Ports = append(cfg.Ports, p)
+	}
+
+	for _, s := range strings.Split(lanHosts, ",") {
+		if s != "" {
+			cfg.LANHosts = append(cfg.LANHosts, s)
+		}
+	}
+
+	cfg.PingInterval = time.Duration(*ping) * time.Second
+	cfg.CfgPollInterval = time.Duration(*poll) * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	a := agent.New(cfg)
+	a.OnCfg = func(res *agent.CfgResult) {
+		if res.NeedUpgrade {
+			log.Println("upgrade available:", res.UpgradeURL)
+		}
+	}
+
+	a.OnNotify = func(n *agent.Notify) {
+		if n.Type == agent.NotifyRestart {
+			// exit and let the supervisor start us again
+			log.Println("restart requested by server")
+			cancel()
+		}
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		cancel()
+	}()
+
+	log.Printf("lproxy agent start, uuid:%s, server:%s", cfg.UUID, cfg.ServerURL)
+	a.Run(ctx)
+	log.Println("lproxy agent exit")
+}
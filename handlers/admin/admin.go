@@ -0,0 +1,236 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"lproxy/server"
+	"lproxy/servercfg"
+	xport "lproxy/xport"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DeviceInfo online device info
+type DeviceInfo struct {
+	*xport.DeviceStats
+
+	PeerAddr     string `json:"peer_addr"`
+	RTTMs        int64  `json:"rtt_ms"`
+	SlotsUsed    int    `json:"slots_used"`
+	SlotsCap     int    `json:"slots_cap"`
+	BandwidthKbs int    `json:"bandwidth_kbs"`
+	Resumable    bool   `json:"resumable"`
+	Detached     bool   `json:"detached"`
+}
+
+// DeviceDetail online device info with its active requests
+type DeviceDetail struct {
+	*DeviceInfo
+
+	Requests []*xport.RequestStats `json:"requests"`
+}
+
+func newDeviceInfo(d *xport.XDevice) *DeviceInfo {
+	used, cap := d.SlotUsage()
+	return &DeviceInfo{
+		DeviceStats:  d.Stats(),
+		PeerAddr:     d.PeerAddr(),
+		RTTMs:        d.RTT().Milliseconds(),
+		SlotsUsed:    used,
+		SlotsCap:     cap,
+		BandwidthKbs: d.Bandwidth(),
+		Resumable:    d.Resumable(),
+		Detached:     d.Detached(),
+	}
+}
+
+// authorized check admin token from 'Authorization' header, it is never
+// accepted from query, which may be logged
+func authorized(ctx *server.RequestContext) bool {
+	auth := ctx.R.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+
+	tk := strings.TrimPrefix(auth, "Bearer ")
+	if tk == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(tk), []byte(servercfg.AdminToken)) == 1
+}
+
+// wrap check admin token before handle
+func wrap(handle server.RequestHandle) server.RequestHandle {
+	return func(ctx *server.RequestContext) {
+		if !authorized(ctx) {
+			log.Println("admin api unauthorized request from:", ctx.R.RemoteAddr)
+			http.Error(ctx.W, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handle(ctx)
+	}
+}
+
+func writeJSON(ctx *server.RequestContext, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		ctx.Log.Println("admin api, Marshal response failed:", err)
+		http.Error(ctx.W, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ctx.W.Header().Set("Content-Type", "application/json")
+	ctx.W.Write(b)
+}
+
+func getDevice(ctx *server.RequestContext) *xport.XDevice {
+	uuid := ctx.Params.ByName("uuid")
+	d := xport.GetDeviceRegistry().Get(uuid)
+	if d == nil {
+		http.Error(ctx.W, "no dev found for uuid", http.StatusNotFound)
+	}
+
+	return d
+}
+
+func listDevicesHandle(ctx *server.RequestContext) {
+	list := make([]*DeviceInfo, 0)
+	for _, d := range xport.GetDeviceRegistry().List() {
+		list = append(list, newDeviceInfo(d))
+	}
+
+	writeJSON(ctx, list)
+}
+
+func getDeviceHandle(ctx *server.RequestContext) {
+	d := getDevice(ctx)
+	if d == nil {
+		return
+	}
+
+	writeJSON(ctx, &DeviceDetail{
+		DeviceInfo: newDeviceInfo(d),
+		Requests:   d.RequestStats(),
+	})
+}
+
+func listRequestsHandle(ctx *server.RequestContext) {
+	d := getDevice(ctx)
+	if d == nil {
+		return
+	}
+
+	writeJSON(ctx, d.RequestStats())
+}
+
+func kickDeviceHandle(ctx *server.RequestContext) {
+	d := getDevice(ctx)
+	if d == nil {
+		return
+	}
+
+	d.Kick()
+	writeJSON(ctx, map[string]int{"error": 0})
+}
+
+func closeRequestHandle(ctx *server.RequestContext) {
+	d := getDevice(ctx)
+	if d == nil {
+		return
+	}
+
+	idx, err := strconv.Atoi(ctx.Params.ByName("idx"))
+	if err != nil || idx < 0 || idx > 65535 {
+		http.Error(ctx.W, "invalid request idx", http.StatusBadRequest)
+		return
+	}
+
+	err = d.CloseRequest(uint16(idx))
+	if err != nil {
+		http.Error(ctx.W, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	writeJSON(ctx, map[string]int{"error": 0})
+}
+
+// BandwidthRequest body of bandwidth setting
+type BandwidthRequest struct {
+	Kbs int `json:"kbs"`
+}
+
+func setBandwidthHandle(ctx *server.RequestContext) {
+	req := &BandwidthRequest{}
+	err := json.Unmarshal(ctx.Body, req)
+	if err != nil || req.Kbs < 0 {
+		http.Error(ctx.W, "invalid bandwidth request", http.StatusBadRequest)
+		return
+	}
+
+	uuid := ctx.Params.ByName("uuid")
+	xport.SetDeviceBandwidth(uuid, req.Kbs)
+
+	d := xport.GetDeviceRegistry().Get(uuid)
+	if d != nil {
+		err = d.PushCfgChanged()
+		if err != nil {
+			ctx.Log.Println("admin api,", err)
+		}
+	}
+
+	writeJSON(ctx, map[string]int{"error": 0})
+}
+
+func restartDeviceHandle(ctx *server.RequestContext) {
+	d := getDevice(ctx)
+	if d == nil {
+		return
+	}
+
+	err := d.PushRestart(ctx.Query.Get("reason"))
+	if err != nil {
+		http.Error(ctx.W, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	writeJSON(ctx, map[string]int{"error": 0})
+}
+
+func upgradeDeviceHandle(ctx *server.RequestContext) {
+	d := getDevice(ctx)
+	if d == nil {
+		return
+	}
+
+	err := d.PushUpgrade()
+	if err != nil {
+		http.Error(ctx.W, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	writeJSON(ctx, map[string]int{"error": 0})
+}
+
+func init() {
+	server.InvokeAfterCfgLoaded(func() {
+		if servercfg.AdminToken == "" {
+			log.Println("admin token not configured, admin api disabled")
+			return
+		}
+
+		p := servercfg.AdminPath
+		server.RegisterGetHandleNoUUID(p+"/devices", wrap(listDevicesHandle))
+		server.RegisterGetHandleNoUUID(p+"/devices/:uuid", wrap(getDeviceHandle))
+		server.RegisterGetHandleNoUUID(p+"/devices/:uuid/requests", wrap(listRequestsHandle))
+		server.RegisterPostHandleNoUUID(p+"/devices/:uuid/kick", wrap(kickDeviceHandle))
+		server.RegisterPostHandleNoUUID(p+"/devices/:uuid/requests/:idx/close", wrap(closeRequestHandle))
+		server.RegisterPostHandleNoUUID(p+"/devices/:uuid/bandwidth", wrap(setBandwidthHandle))
+		server.RegisterPostHandleNoUUID(p+"/devices/:uuid/restart", wrap(restartDeviceHandle))
+		server.RegisterPostHandleNoUUID(p+"/devices/:uuid/upgrade", wrap(upgradeDeviceHandle))
+	})
+}
@@ -0,0 +1,233 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"lproxy/server"
+	"lproxy/servercfg"
+	xport "lproxy/xport"
+	"lproxy/xport/agent"
+	"lproxy/xport/lws"
+	"lproxy/xport/xporttest"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testAdminToken = "admin#test#token"
+)
+
+// startServer serve admin api and xport on in-memory listener
+func startServer() (*httptest.Server, *lws.PipeListener) {
+	return xporttest.StartServer(func() {
+		servercfg.AdminToken = testAdminToken
+	})
+}
+
+func adminDo(t *testing.T, l *lws.PipeListener, method string, url string, token string, v interface{}) int {
+	req, _ := http.NewRequest(method, url, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := &http.Client{Transport: &http.Transport{DialContext: l.Dial}}
+	rsp, err := client.Do(req)
+	if err != nil {
+		t.Fatal("admin api request:", err)
+	}
+
+	defer rsp.Body.Close()
+	if v != nil && rsp.StatusCode == http.StatusOK {
+		err = json.NewDecoder(rsp.Body).Decode(v)
+		if err != nil {
+			t.Fatal("admin api response:", err)
+		}
+	}
+
+	return rsp.StatusCode
+}
+
+func TestAdminAPI(t *testing.T) {
+	ts, l := startServer()
+
+	base := ts.URL + servercfg.AdminPath
+
+	// token is only accepted from header
+	if code := adminDo(t, l, "GET", base+"/devices", "", nil); code != http.StatusUnauthorized {
+		t.Fatal("request without token should be rejected, got:", code)
+	}
+
+	if code := adminDo(t, l, "GET", base+"/devices?atok="+testAdminToken, "", nil); code != http.StatusUnauthorized {
+		t.Fatal("token in query should be rejected, got:", code)
+	}
+
+	if code := adminDo(t, l, "GET", base+"/devices", "bad token", nil); code != http.StatusUnauthorized {
+		t.Fatal("request with bad token should be rejected, got:", code)
+	}
+
+	if code := adminDo(t, l, "GET", base+"/devices/no-such-dev", testAdminToken, nil); code != http.StatusNotFound {
+		t.Fatal("unknown device should be not found, got:", code)
+	}
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("echo listen:", err)
+	}
+
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+
+			go io.Copy(c, c)
+		}
+	}()
+
+	uuid := fmt.Sprintf("admin-test-%d", time.Now().UnixNano())
+	a := agent.New(agent.Config{
+		ServerURL:    ts.URL,
+		UUID:         uuid,
+		PingInterval: time.Second,
+		NetDial:      l.Dial,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for xport.GetDeviceRegistry().Get(uuid) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("device not online")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	list := []*DeviceInfo{}
+	if code := adminDo(t, l, "GET", base+"/devices", testAdminToken, &list); code != http.StatusOK {
+		t.Fatal("list devices:", code)
+	}
+
+	found := false
+	for _, d := range list {
+		found = found || d.UUID == uuid
+	}
+
+	if !found {
+		t.Fatal("device should be listed")
+	}
+
+	listen := xporttest.FreeAddr()
+	err = xport.AddTCPMapping(listen, uuid, uint16(echo.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatal("add tcp mapping:", err)
+	}
+
+	defer xport.RemoveTCPMapping(listen)
+
+	c, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal("dial mapping:", err)
+	}
+
+	defer c.Close()
+	c.Write([]byte("hello"))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(c, make([]byte, 5))
+	if err != nil {
+		t.Fatal("echo through mapping:", err)
+	}
+
+	detail := &DeviceDetail{}
+	if code := adminDo(t, l, "GET", base+"/devices/"+uuid, testAdminToken, detail); code != http.StatusOK {
+		t.Fatal("get device:", code)
+	}
+
+	if len(detail.Requests) != 1 || detail.Requests[0].BytesRecv != 5 {
+		t.Fatal("device should have the active request:", detail.Requests)
+	}
+
+	url := fmt.Sprintf("%s/devices/%s/requests/%d/close", base, uuid, detail.Requests[0].Idx)
+	if code := adminDo(t, l, "POST", url, testAdminToken, nil); code != http.StatusOK {
+		t.Fatal("close request:", code)
+	}
+
+	_, err = c.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatal("closed request should end client conn, got:", err)
+	}
+
+	// request is freed after its client conn closed
+	d := xport.GetDeviceRegistry().Get(uuid)
+	for len(d.RequestStats()) > 0 {
+		if time.Now().After(deadline.Add(5 * time.Second)) {
+			t.Fatal("closed request should be freed")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if code := adminDo(t, l, "POST", url, testAdminToken, nil); code != http.StatusNotFound {
+		t.Fatal("close inactive request should be not found, got:", code)
+	}
+
+	if code := adminDo(t, l, "POST", base+"/devices/"+uuid+"/kick", testAdminToken, nil); code != http.StatusOK {
+		t.Fatal("kick device:", code)
+	}
+}
+
+func TestAdminNotifyUnsupported(t *testing.T) {
+	ts, l := startServer()
+
+	cases := []struct {
+		ver  string
+		code int
+	}{
+		// device without 'ver' speaks the base protocol, which has no notify
+		{"", http.StatusServiceUnavailable},
+		// notify does not require the later LAN host version
+		{"2", http.StatusOK},
+	}
+
+	for _, tc := range cases {
+		uuid := fmt.Sprintf("admin-ver%s-%d", tc.ver, time.Now().UnixNano())
+		u := "ws" + strings.TrimPrefix(ts.URL, "http") + servercfg.XPortLWSPath +
+			"?cap=1&tok=" + url.QueryEscape(server.GenTK(uuid))
+		if tc.ver != "" {
+			u = u + "&ver=" + tc.ver
+		}
+
+		d := &lws.Dialer{NetDial: l.Dial, HandshakeTimeout: 5 * time.Second}
+		c, _, err := d.DialContext(context.Background(), u, nil)
+		if err != nil {
+			t.Fatal("dial lws:", err)
+		}
+
+		defer c.Close()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for xport.GetDeviceRegistry().Get(uuid) == nil {
+			if time.Now().After(deadline) {
+				t.Fatal("device not online")
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		base := ts.URL + servercfg.AdminPath
+		if code := adminDo(t, l, "POST", base+"/devices/"+uuid+"/restart", testAdminToken, nil); code != tc.code {
+			t.Fatalf("restart device of ver %q, got:%d, want:%d", tc.ver, code, tc.code)
+		}
+	}
+}
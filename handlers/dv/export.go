@@ -0,0 +1,45 @@
+package dv
+
+import (
+	context "context"
+	"lproxy/server"
+	xport "lproxy/xport"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type myDvExportService struct{}
+
+// KickoutUuid disconnect device and invalidate its token
+func (s *myDvExportService) KickoutUuid(ctx context.Context, req *Kickout) (*Empty, error) {
+	uuid := req.GetUuid()
+	log.Println("gRPC KickoutUuid called, uuid:", uuid)
+
+	server.RevokeTK(uuid)
+
+	d := xport.GetDeviceRegistry().Get(uuid)
+	if d != nil {
+		d.Kick()
+	}
+
+	return &Empty{}, nil
+}
+
+// UuidCfgChanged apply new bandwidth limit to device and notify it
+func (s *myDvExportService) UuidCfgChanged(ctx context.Context, req *CfgChangeNotify) (*Empty, error) {
+	uuid := req.GetUuid()
+	kbs := req.GetKbPerSecond()
+	log.Printf("gRPC UuidCfgChanged called, uuid:%s, kb_per_second:%d", uuid, kbs)
+
+	xport.SetDeviceBandwidth(uuid, int(kbs))
+
+	d := xport.GetDeviceRegistry().Get(uuid)
+	if d != nil {
+		err := d.PushCfgChanged()
+		if err != nil {
+			log.Println("gRPC UuidCfgChanged,", err)
+		}
+	}
+
+	return &Empty{}, nil
+}
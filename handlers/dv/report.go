@@ -3,7 +3,7 @@ package dv
 import (
 	context "context"
 	"lproxy/server"
-	"lproxy/servercfg"
+	xport "lproxy/xport"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -17,6 +17,13 @@ func (s *myReportService) Report(c context.Context, r *BandwidthStatistics) (*Re
 	for _, s := range statistics {
 		log.Printf("gRPC report service, uuid:%s, send:%d, recv:%d",
 			s.GetUuid(), s.GetSendBytes(), s.GetRecvBytes())
+
+		// cross-check with the xport traffic counted by server
+		su := serverUsageForReport(s.GetUuid())
+		if su != nil {
+			log.Printf("gRPC report service, uuid:%s, server counted xport send:%d, recv:%d",
+				su.GetUuid(), su.GetSendBytes(), su.GetRecvBytes())
+		}
 	}
 
 	reply := &ReportResult{Code: 0}
@@ -26,7 +33,7 @@ func (s *myReportService) Report(c context.Context, r *BandwidthStatistics) (*Re
 func (s *myDvImportService) PullCfg(ctx context.Context, req *CfgPullRequest) (*CfgPullResult, error) {
 	log.Println("gRPC PullCfg called, uuid:", req.GetUuid())
 
-	reply := &CfgPullResult{Code: 0, BandwidthLimitKbs: uint64(servercfg.BandwidthKbs)}
+	reply := &CfgPullResult{Code: 0, BandwidthLimitKbs: uint64(xport.GetDeviceBandwidth(req.GetUuid()))}
 
 	return reply, nil
 }
@@ -36,5 +43,8 @@ func init() {
 		s := server.GetGRPCServer()
 		RegisterBandwidthReportServer(s, &myReportService{})
 		RegisterDeviceCfgPullServer(s, &myDvImportService{})
+		RegisterDvExportServer(s, &myDvExportService{})
+		// export service controls devices, only for admin
+		server.RequireGRPCAdmin("DvExport")
 	})
 }
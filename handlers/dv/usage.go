@@ -0,0 +1,63 @@
+package dv
+
+import (
+	xport "lproxy/xport"
+	"sync"
+	"time"
+)
+
+type usageSnapshot struct {
+	connectedAt time.Time
+	sent        uint64
+	recv        uint64
+}
+
+// usageTracker compute device traffic in a period from server-side counters
+type usageTracker struct {
+	mutex     sync.Mutex
+	snapshots map[string]*usageSnapshot
+}
+
+// reportUsage used to cross-check the report from device
+var reportUsage = newUsageTracker()
+
+func newUsageTracker() *usageTracker {
+	return &usageTracker{snapshots: make(map[string]*usageSnapshot)}
+}
+
+// delta bytes count since last call for the same device
+func (t *usageTracker) delta(stats *xport.DeviceStats) *BandwidthUsage {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	usage := &BandwidthUsage{
+		Uuid:      stats.UUID,
+		SendBytes: stats.BytesSent,
+		RecvBytes: stats.BytesRecv,
+	}
+
+	last, ok := t.snapshots[stats.UUID]
+	if ok && last.connectedAt.Equal(stats.ConnectedAt) {
+		// same lws link, otherwise device has reconnected and counters restart from zero
+		usage.SendBytes = stats.BytesSent - last.sent
+		usage.RecvBytes = stats.BytesRecv - last.recv
+	}
+
+	t.snapshots[stats.UUID] = &usageSnapshot{
+		connectedAt: stats.ConnectedAt,
+		sent:        stats.BytesSent,
+		recv:        stats.BytesRecv,
+	}
+
+	return usage
+}
+
+// serverUsageForReport xport traffic of device counted by server since its last report
+func serverUsageForReport(uuid string) *BandwidthUsage {
+	d := xport.GetDeviceRegistry().Get(uuid)
+	if d == nil {
+		return nil
+	}
+
+	return reportUsage.delta(d.Stats())
+}
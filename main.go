@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"lproxy/server"
@@ -11,6 +13,7 @@ import (
 
 	log "github.com/sirupsen/logrus"
 
+	_ "lproxy/handlers/admin"
 	_ "lproxy/handlers/auth"
 	_ "lproxy/xport"
 	_ "lproxy/handlers/sayhello"
@@ -34,6 +37,8 @@ func main() {
 	runtime.GOMAXPROCS(1)
 
 	version := flag.Bool("v", false, "show version")
+	clientAccount := flag.String("g", "", "generate xport client token for account, then exit")
+	genKey := flag.Bool("k", false, "generate a random key for token_keys, then exit")
 
 	flag.Parse()
 
@@ -42,6 +47,17 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *genKey {
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		if err != nil {
+			log.Fatal("generate key failed:", err)
+		}
+
+		fmt.Printf("%s\n", base64.StdEncoding.EncodeToString(key))
+		os.Exit(0)
+	}
+
 	if redisServerURL != "" {
 		servercfg.RedisServer = redisServerURL
 	}
@@ -66,6 +82,15 @@ func main() {
 		log.Fatal("please specify a valid config file path")
 	}
 
+	if *clientAccount != "" {
+		if servercfg.XPortClientTokenKey == "" && len(servercfg.XPortClientTokenKeys) == 0 {
+			log.Fatal("please specify xport_client_token_keys or xport_client_token_key in config file")
+		}
+
+		fmt.Printf("%s\n", server.GenClientTK(*clientAccount))
+		os.Exit(0)
+	}
+
 	log.Println("try to start  lproxy server, version:", server.GetVersion())
 
 	server.OnCfgLoaded()
@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
 	log "github.com/sirupsen/logrus"
@@ -63,9 +64,14 @@ func newReqContext(r *http.Request, requiredUUID bool) *RequestContext {
 	return ctx
 }
 
-// wrapGetHandleInternal 包装 get handle
-func wrapGetHandleInternal(handle RequestHandle, requiredUUID bool) httprouter.Handle {
+// wrapGetHandleInternal 包装 get handle, stream handle such as proxy
+// is not bounded by requestTimeout
+func wrapGetHandleInternal(handle RequestHandle, requiredUUID bool, stream bool) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		if stream {
+			clearRequestDeadline(w)
+		}
+
 		ctx := newReqContext(r, requiredUUID)
 		if ctx == nil {
 			return
@@ -119,7 +125,7 @@ func RegisterGetHandle(subPath string, handle RequestHandle) {
 		log.Panic("subPath with 'GET' has been register, subPath:", subPath)
 	}
 
-	rootRouter.GET(path, wrapGetHandleInternal(handle, true))
+	rootRouter.GET(path, wrapGetHandleInternal(handle, true, false))
 }
 
 // RegisterPostHandle 注册http post handle
@@ -167,7 +173,42 @@ func RegisterGetHandleNoUUID(subPath string, handle RequestHandle) {
 		log.Panic("subPath with 'GET' has been register, subPath:", subPath)
 	}
 
-	rootRouter.GET(path, wrapGetHandleInternal(handle, false))
+	rootRouter.GET(path, wrapGetHandleInternal(handle, false, false))
+}
+
+// RegisterAnyHandleNoUUID register http handle for all methods, body is not read,
+// handle reads it from R, e.g. for proxy
+func RegisterAnyHandleNoUUID(subPath string, handle RequestHandle) {
+	log.Info("RegisterAnyHandleNoUUID:", subPath)
+	if subPath[0] != '/' {
+		log.Panic("RegisterAnyHandleNoUUID subPath must begin with '/', :", subPath)
+	}
+
+	path := rootPath + subPath
+	for _, method := range anyMethods {
+		h, _, _ := rootRouter.Lookup(method, path)
+		if h != nil {
+			log.Panicf("subPath with '%s' has been register, subPath:%s", method, subPath)
+		}
+
+		rootRouter.Handle(method, path, wrapGetHandleInternal(handle, false, true))
+	}
+}
+
+// RegisterHostHandle register http handle for requests whose host ends with suffix,
+// e.g. ".dev.example.com", it takes precedence over path handles, body is not read
+func RegisterHostHandle(suffix string, handle RequestHandle) {
+	log.Info("RegisterHostHandle:", suffix)
+	for _, hh := range hostHandles {
+		if hh.suffix == suffix {
+			log.Panic("host suffix has been register, suffix:", suffix)
+		}
+	}
+
+	hostHandles = append(hostHandles, &hostHandle{
+		suffix: strings.ToLower(suffix),
+		handle: wrapGetHandleInternal(handle, false, true),
+	})
 }
 
 var (
@@ -5,12 +5,14 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"lproxy/servercfg"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -27,8 +29,86 @@ const (
 	errTokenDecrypt = 2
 	errTokenFormat  = 3
 	errTokenExpired = 4
+	errTokenRevoked = 5
+	errTokenKey     = 6
 )
 
+const (
+	// token format: version(1) keyID(1) nonce(12) sealed(timestamp(8) account),
+	// version and keyID are authenticated as additional data
+	tokenVersionAEAD = 1
+	tokenHeaderSize  = 2
+)
+
+var (
+	// revoked device uuid -> unix time, tokens generated no later than it are invalid,
+	// entries older than myTimeExpired are pruned since such tokens are expired anyway
+	revokedMutex sync.Mutex
+	revoked      = make(map[string]int)
+	revokedStore TKRevokeStore
+)
+
+// TKRevokeStore shares revocations among cluster nodes, see SetTKRevokeStore
+type TKRevokeStore interface {
+	// Revoke tokens of account generated no later than t, record is kept for ttl seconds
+	Revoke(account string, t int, ttl int) error
+	// Revoked the time account was revoked, 0 if never
+	Revoked(account string) (int, error)
+}
+
+// SetTKRevokeStore share revocations by store, besides the local record
+func SetTKRevokeStore(store TKRevokeStore) {
+	revokedMutex.Lock()
+	revokedStore = store
+	revokedMutex.Unlock()
+}
+
+// RevokeTK 使设备account当前已签发的token失效, 客户端token不受影响
+func RevokeTK(account string) {
+	now := int(time.Now().Unix())
+
+	revokedMutex.Lock()
+	for a, t := range revoked {
+		if now-t > myTimeExpired {
+			delete(revoked, a)
+		}
+	}
+
+	revoked[account] = now
+	store := revokedStore
+	revokedMutex.Unlock()
+
+	if store != nil {
+		err := store.Revoke(account, now, myTimeExpired)
+		if err != nil {
+			log.Printf("RevokeTK, share revocation of %s failed:%v", account, err)
+		}
+	}
+}
+
+func isRevoked(account string, timestamp int) bool {
+	revokedMutex.Lock()
+	t, ok := revoked[account]
+	store := revokedStore
+	revokedMutex.Unlock()
+
+	if ok && timestamp <= t {
+		return true
+	}
+
+	if store == nil {
+		return false
+	}
+
+	t, err := store.Revoked(account)
+	if err != nil {
+		log.Printf("isRevoked, query revocation of %s failed:%v", account, err)
+		return false
+	}
+
+	return t > 0 && timestamp <= t
+}
+
 func verifyToken(r *http.Request) (string, bool) {
 	var tk = r.Header.Get("tk")
 
@@ -46,21 +126,98 @@ func verifyToken(r *http.Request) (string, bool) {
 
 // GenTK 生成一个加密的token
 func GenTK(account string) string {
+	return genTKWithKeys(servercfg.TokenKeys, servercfg.TokenKey, account)
+}
+
+// GenClientTK 生成xport客户端token, 与设备token使用不同的key
+func GenClientTK(account string) string {
+	return genTKWithKeys(servercfg.XPortClientTokenKeys, servercfg.XPortClientTokenKey, account)
+}
+
+// VerifyClientTK 校验xport客户端token, 返回account
+func VerifyClientTK(token string) (string, bool) {
+	if servercfg.XPortClientTokenKey == "" && len(servercfg.XPortClientTokenKeys) == 0 {
+		log.Println("VerifyClientTK, no client token key configured")
+		return "", false
+	}
+
+	v, e := parseTKWithKeys(servercfg.XPortClientTokenKeys, servercfg.XPortClientTokenKey, token)
+	if e == errTokenSuccess {
+		return v, true
+	}
+
+	return v, false
+}
+
+// genTKWithKeys issue token with the last key, legacy token if no keys
+func genTKWithKeys(keys []*servercfg.TokenKeyCfg, legacyKey string, account string) string {
+	if len(keys) == 0 {
+		return genTKWithKey(legacyKey, account)
+	}
+
+	return sealTK(keys[len(keys)-1], account, time.Now().Unix())
+}
+
+func genTKWithKey(key string, account string) string {
 	var plainTK = fmt.Sprintf("%s@%d", account, time.Now().Unix())
 	// log.Println("GenTK, plainTK is:", plainTK)
-	return encrypt([]byte(servercfg.TokenKey), plainTK)
+	return encrypt([]byte(key), plainTK)
 }
 
+// parseTK parse device token, which may be revoked by RevokeTK
 func parseTK(token string) (string, int) {
+	account, timestamp, e := parseTKTime(servercfg.TokenKeys, servercfg.TokenKey, token)
+	if e != errTokenSuccess {
+		return "", e
+	}
+
+	if isRevoked(account, timestamp) {
+		log.Println("ParseTK, token has been revoked")
+		return "", errTokenRevoked
+	}
+
+	return account, errTokenSuccess
+}
+
+// parseTKWithKeys verify token with the key it carries, legacy token is
+// accepted if no keys, or TokenAcceptLegacy during migration
+func parseTKWithKeys(keys []*servercfg.TokenKeyCfg, legacyKey string, token string) (string, int) {
+	account, _, e := parseTKTime(keys, legacyKey, token)
+	return account, e
+}
+
+// parseTKTime like parseTKWithKeys, also return the time token generated
+func parseTKTime(keys []*servercfg.TokenKeyCfg, legacyKey string, token string) (string, int, int) {
+	if len(keys) == 0 {
+		return parseTKWithKey(legacyKey, token)
+	}
+
+	if token == "" {
+		return "", 0, errTokenEmpty
+	}
+
+	account, timestamp, e := openTK(keys, token)
+	if e != errTokenSuccess {
+		if servercfg.TokenAcceptLegacy {
+			return parseTKWithKey(legacyKey, token)
+		}
+
+		return "", 0, e
+	}
+
+	return checkTK(account, timestamp)
+}
+
+func parseTKWithKey(key string, token string) (string, int, int) {
 	// log.Printf("ParseTk, tok:%s, len:%d\n", token, len(token))
 	if token == "" {
-		return "", errTokenEmpty
+		return "", 0, errTokenEmpty
 	}
 
-	var plainTK, err = decrypt([]byte(servercfg.TokenKey), token)
+	var plainTK, err = decrypt([]byte(key), token)
 	if err != nil {
 		log.Println("ParseTK, err:", err)
-		return "", errTokenDecrypt
+		return "", 0, errTokenDecrypt
 	}
 
 	//log.Println("ParseTK, plainTK is:", plainTK)
@@ -68,24 +225,100 @@ func parseTK(token string) (string, int) {
 	var splits = strings.Split(plainTK, "@")
 	if len(splits) != 2 {
 		log.Println("ParseTK, err: no @ at text")
-		return "", errTokenFormat
+		return "", 0, errTokenFormat
 	}
 
 	timestamp, err := strconv.Atoi(splits[1])
 	if err != nil {
 		log.Println("ParseTK, err: ", err)
-		return "", errTokenFormat
+		return "", 0, errTokenFormat
 	}
 
+	return checkTK(splits[0], timestamp)
+}
+
+// checkTK check expiration
+func checkTK(account string, timestamp int) (string, int, int) {
 	var now = int(time.Now().Unix())
-	//log.Printf("ParseTK, account:%s, timestamp:%d, now:%d", splits[0], timestamp, now)
+	//log.Printf("ParseTK, account:%s, timestamp:%d, now:%d", account, timestamp, now)
 
 	if now-timestamp > (myTimeExpired) {
 		log.Println("ParseTK, token has been expired")
-		return "", errTokenExpired
+		return "", 0, errTokenExpired
+	}
+
+	return account, timestamp, errTokenSuccess
+}
+
+func newAEAD(secret []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// sealTK seal account and timestamp to base64 token using AES-GCM
+func sealTK(key *servercfg.TokenKeyCfg, account string, timestamp int64) string {
+	aead, err := newAEAD(key.Secret)
+	if err != nil {
+		panic(err)
+	}
+
+	header := []byte{tokenVersionAEAD, byte(key.ID)}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		panic(err)
+	}
+
+	plaintext := make([]byte, 8+len(account))
+	binary.BigEndian.PutUint64(plaintext, uint64(timestamp))
+	copy(plaintext[8:], account)
+
+	token := append(header, nonce...)
+	token = aead.Seal(token, nonce, plaintext, header)
+
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+// openTK verify and decrypt token, return account and timestamp
+func openTK(keys []*servercfg.TokenKeyCfg, token string) (string, int, int) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(data) < tokenHeaderSize || data[0] != tokenVersionAEAD {
+		return "", 0, errTokenFormat
+	}
+
+	var key *servercfg.TokenKeyCfg
+	for _, k := range keys {
+		if k.ID == int(data[1]) {
+			key = k
+			break
+		}
+	}
+
+	if key == nil {
+		return "", 0, errTokenKey
+	}
+
+	aead, err := newAEAD(key.Secret)
+	if err != nil {
+		return "", 0, errTokenKey
+	}
+
+	header := data[:tokenHeaderSize]
+	data = data[tokenHeaderSize:]
+	if len(data) < aead.NonceSize() {
+		return "", 0, errTokenFormat
+	}
+
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], header)
+	if err != nil || len(plaintext) < 8 {
+		return "", 0, errTokenDecrypt
 	}
 
-	return splits[0], errTokenSuccess
+	timestamp := int(binary.BigEndian.Uint64(plaintext))
+	return string(plaintext[8:]), timestamp, errTokenSuccess
 }
 
 // encrypt string to base64 crypto using AES
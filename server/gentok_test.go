@@ -1,7 +1,11 @@
 package server
 
 import (
+	"bytes"
+	"encoding/base64"
+	"lproxy/servercfg"
 	"testing"
+	"time"
 )
 
 func BenchmarkTokDecode(b *testing.B) {
@@ -19,3 +23,138 @@ func BenchmarkTokEncode(b *testing.B) {
 		GenTK(uuid)
 	}
 }
+
+func testKeys(ids ...int) []*servercfg.TokenKeyCfg {
+	keys := make([]*servercfg.TokenKeyCfg, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, &servercfg.TokenKeyCfg{ID: id, Secret: bytes.Repeat([]byte{byte(id)}, 32)})
+	}
+
+	return keys
+}
+
+func TestTokAEAD(t *testing.T) {
+	uuid := "738b935b-e5c9-44b0-8524-290146ec08e6"
+	keys := testKeys(1)
+	token := genTKWithKeys(keys, "", uuid)
+
+	account, e := parseTKWithKeys(keys, "", token)
+	if e != errTokenSuccess || account != uuid {
+		t.Fatal("parse token failed:", account, e)
+	}
+
+	// any bit flipped is rejected
+	data, _ := base64.RawURLEncoding.DecodeString(token)
+	for i := range data {
+		data[i] ^= 0x01
+		_, e = parseTKWithKeys(keys, "", base64.RawURLEncoding.EncodeToString(data))
+		if e == errTokenSuccess {
+			t.Fatal("tampered token accepted, byte:", i)
+		}
+
+		data[i] ^= 0x01
+	}
+}
+
+func TestTokKeyRotation(t *testing.T) {
+	uuid := "738b935b-e5c9-44b0-8524-290146ec08e6"
+	old := genTKWithKeys(testKeys(1), "", uuid)
+
+	// new key is appended, old tokens still verify, new tokens use new key
+	keys := testKeys(1, 2)
+	if _, e := parseTKWithKeys(keys, "", old); e != errTokenSuccess {
+		t.Fatal("old token should verify after rotation:", e)
+	}
+
+	token := genTKWithKeys(keys, "", uuid)
+	data, _ := base64.RawURLEncoding.DecodeString(token)
+	if data[0] != tokenVersionAEAD || data[1] != 2 {
+		t.Fatal("token should be issued with the latest key, header:", data[:2])
+	}
+
+	// old key is retired
+	if _, e := parseTKWithKeys(testKeys(2), "", old); e != errTokenKey {
+		t.Fatal("token of retired key should be rejected:", e)
+	}
+}
+
+func TestTokLegacy(t *testing.T) {
+	uuid := "738b935b-e5c9-44b0-8524-290146ec08e6"
+	legacyKey := "@yymmxxkk#$yzilm"
+	legacy := genTKWithKeys(nil, legacyKey, uuid)
+
+	if account, e := parseTKWithKeys(nil, legacyKey, legacy); e != errTokenSuccess || account != uuid {
+		t.Fatal("legacy token should verify without keys:", account, e)
+	}
+
+	keys := testKeys(1)
+	if _, e := parseTKWithKeys(keys, legacyKey, legacy); e == errTokenSuccess {
+		t.Fatal("legacy token should be rejected once keys configured")
+	}
+
+	servercfg.TokenAcceptLegacy = true
+	defer func() { servercfg.TokenAcceptLegacy = false }()
+
+	if account, e := parseTKWithKeys(keys, legacyKey, legacy); e != errTokenSuccess || account != uuid {
+		t.Fatal("legacy token should verify during migration:", account, e)
+	}
+}
+
+type testRevokeStore map[string]int
+
+func (s testRevokeStore) Revoke(account string, t int, ttl int) error {
+	s[account] = t
+	return nil
+}
+
+func (s testRevokeStore) Revoked(account string) (int, error) {
+	return s[account], nil
+}
+
+func TestTokRevoke(t *testing.T) {
+	uuid := "revoke-738b935b-e5c9-44b0-8524-290146ec08e6"
+	servercfg.XPortClientTokenKey = "0123456789abcdef"
+	defer func() { servercfg.XPortClientTokenKey = "" }()
+
+	token := GenTK(uuid)
+	client := GenClientTK(uuid)
+
+	// stale entry is pruned by the next revocation
+	revokedMutex.Lock()
+	revoked["stale"] = int(time.Now().Unix()) - myTimeExpired - 1
+	revokedMutex.Unlock()
+
+	RevokeTK(uuid)
+	if _, e := parseTK(token); e != errTokenRevoked {
+		t.Fatal("revoked device token should be rejected:", e)
+	}
+
+	revokedMutex.Lock()
+	_, stale := revoked["stale"]
+	revokedMutex.Unlock()
+	if stale {
+		t.Fatal("expired revocation should be pruned")
+	}
+
+	// client account of the same name is not affected
+	if account, ok := VerifyClientTK(client); !ok || account != uuid {
+		t.Fatal("client token should not be revoked with device:", account)
+	}
+
+	// revocation by other node is seen through store
+	store := testRevokeStore{}
+	SetTKRevokeStore(store)
+	defer SetTKRevokeStore(nil)
+
+	other := "revoke-other-node"
+	token = GenTK(other)
+	store[other] = int(time.Now().Unix())
+	if _, e := parseTK(token); e != errTokenRevoked {
+		t.Fatal("token revoked by other node should be rejected:", e)
+	}
+
+	RevokeTK(uuid)
+	if store[uuid] == 0 {
+		t.Fatal("revocation should be shared by store")
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"lproxy/servercfg"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// grpc services that require admin token
+	grpcAdminMutex    sync.Mutex
+	grpcAdminServices = make(map[string]bool)
+)
+
+// RequireGRPCAdmin calls to grpc service must carry admin token by
+// 'authorization: Bearer <admin_token>' metadata, refused if no admin token configured
+func RequireGRPCAdmin(service string) {
+	grpcAdminMutex.Lock()
+	grpcAdminServices[service] = true
+	grpcAdminMutex.Unlock()
+}
+
+func grpcRequireAdmin(fullMethod string) bool {
+	// full method is "/service/method"
+	service := strings.TrimPrefix(fullMethod, "/")
+	if i := strings.Index(service, "/"); i >= 0 {
+		service = service[:i]
+	}
+
+	grpcAdminMutex.Lock()
+	defer grpcAdminMutex.Unlock()
+
+	return grpcAdminServices[service]
+}
+
+func grpcAuthorized(ctx context.Context) bool {
+	if servercfg.AdminToken == "" {
+		return false
+	}
+
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return false
+	}
+
+	for _, auth := range md.Get("authorization") {
+		if !strings.HasPrefix(auth, "Bearer ") {
+			continue
+		}
+
+		tk := strings.TrimPrefix(auth, "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(tk), []byte(servercfg.AdminToken)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// grpcAuthInterceptor check admin token for services registered by RequireGRPCAdmin
+func grpcAuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	if grpcRequireAdmin(info.FullMethod) && !grpcAuthorized(ctx) {
+		log.Println("grpc unauthorized call:", info.FullMethod)
+		return nil, status.Error(codes.Unauthenticated, "invalid admin token")
+	}
+
+	return handler(ctx, req)
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"lproxy/servercfg"
+	"testing"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCAuth(t *testing.T) {
+	RequireGRPCAdmin("TestAdmin")
+
+	call := func(method string, token string) codes.Code {
+		ctx := context.Background()
+		if token != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+token))
+		}
+
+		info := &grpc.UnaryServerInfo{FullMethod: method}
+		_, err := grpcAuthInterceptor(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+
+		return status.Code(err)
+	}
+
+	servercfg.AdminToken = ""
+	if code := call("/TestAdmin/Do", ""); code != codes.Unauthenticated {
+		t.Fatal("admin service should be refused without admin token configured:", code)
+	}
+
+	servercfg.AdminToken = "grpc#admin#token"
+	defer func() { servercfg.AdminToken = "" }()
+
+	if code := call("/TestAdmin/Do", ""); code != codes.Unauthenticated {
+		t.Fatal("admin service should be refused without token:", code)
+	}
+
+	if code := call("/TestAdmin/Do", "bad"); code != codes.Unauthenticated {
+		t.Fatal("admin service should be refused with bad token:", code)
+	}
+
+	if code := call("/TestAdmin/Do", "grpc#admin#token"); code != codes.OK {
+		t.Fatal("admin service should be allowed with token:", code)
+	}
+
+	if code := call("/TestPublic/Do", ""); code != codes.OK {
+		t.Fatal("other service should not require token:", code)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/pem"
 	"fmt"
 	"lproxy/servercfg"
+	"net"
 	"net/http"
 	"time"
 
@@ -24,10 +25,64 @@ import (
 var (
 	// 根router，只有http server看到
 	rootRouter = httprouter.New()
-	grpcServer = grpc.NewServer()
+	grpcServer = grpc.NewServer(grpc.UnaryInterceptor(grpcAuthInterceptor))
 	rootPath   = ""
+
+	// handles selected by host, see RegisterHostHandle
+	hostHandles []*hostHandle
+
+	anyMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+)
+
+const (
+	// requestTimeout bounds reading and writing of request, stream handles
+	// such as proxy clear it, see clearRequestDeadline
+	requestTimeout = 5 * time.Second
+	idleTimeout    = 120 * time.Second
 )
 
+// clearRequestDeadline lift requestTimeout for long-lived stream, it works for
+// HTTP/2 stream as well, the server sets deadlines again for the next request
+// of a keep-alive connection
+func clearRequestDeadline(w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	err := rc.SetReadDeadline(time.Time{})
+	if err == nil {
+		err = rc.SetWriteDeadline(time.Time{})
+	}
+
+	if err != nil {
+		log.Println("clearRequestDeadline failed:", err)
+	}
+}
+
+type hostHandle struct {
+	suffix string
+	handle httprouter.Handle
+}
+
+// rootHandler dispatch by host first, then by rootRouter
+type rootHandler struct{}
+
+func (rootHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(hostHandles) > 0 {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		host = strings.ToLower(host)
+		for _, hh := range hostHandles {
+			if strings.HasSuffix(host, hh.suffix) {
+				hh.handle(w, r, nil)
+				return
+			}
+		}
+	}
+
+	rootRouter.ServeHTTP(w, r)
+}
+
 // GetVersion server version string
 func GetVersion() string {
 	return "0.1.0"
@@ -38,6 +93,11 @@ func GetVersionCode() int {
 	return 1
 }
 
+// GetHTTPHandler get root http handler, for serving by other server such as httptest
+func GetHTTPHandler() http.Handler {
+	return rootHandler{}
+}
+
 // CreateHTTPServer 启动服务器
 func CreateHTTPServer() {
 	log.Printf("CreateHTTPServer")
@@ -76,10 +136,10 @@ func acceptHTTPRequest() {
 			AllowedHeaders:   []string{"*"},           // we need this line for cors to allow cross-origin
 			ExposedHeaders:   []string{"Set-Session"}, // we need this line for cors to set Access-Control-Expose-Headers
 		})
-		hh = c.Handler(rootRouter)
+		hh = c.Handler(rootHandler{})
 	} else {
 		// 对外服务器不应该允许跨域访问
-		hh = rootRouter
+		hh = rootHandler{}
 	}
 
 	mm := &myGRPCMux{
@@ -107,12 +167,14 @@ func acceptHTTPRequest() {
 
 		config := &tls.Config{Certificates: []tls.Certificate{cert}}
 		s := &http.Server{
-			Addr:           portStr,
-			Handler:        mm,
-			ReadTimeout:    5 * time.Second,
-			WriteTimeout:   5 * time.Second,
-			MaxHeaderBytes: 1 << 10,
-			TLSConfig:      config,
+			Addr:              portStr,
+			Handler:           mm,
+			ReadHeaderTimeout: requestTimeout,
+			ReadTimeout:       requestTimeout,
+			WriteTimeout:      requestTimeout,
+			IdleTimeout:       idleTimeout,
+			MaxHeaderBytes:    1 << 10,
+			TLSConfig:         config,
 		}
 
 		log.Printf("Https server listen at:%d\n", servercfg.ServerPort)
@@ -123,11 +185,13 @@ func acceptHTTPRequest() {
 		}
 	} else {
 		s := &http.Server{
-			Addr:           portStr,
-			Handler:        mm,
-			ReadTimeout:    5 * time.Second,
-			WriteTimeout:   5 * time.Second,
-			MaxHeaderBytes: 1 << 10,
+			Addr:              portStr,
+			Handler:           mm,
+			ReadHeaderTimeout: requestTimeout,
+			ReadTimeout:       requestTimeout,
+			WriteTimeout:      requestTimeout,
+			IdleTimeout:       idleTimeout,
+			MaxHeaderBytes:    1 << 10,
 		}
 
 		log.Printf("Http server listen at:%d\n", servercfg.ServerPort)
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// TestRequestDeadline stream handle outlives server timeouts on both HTTP/1
+// and HTTP/2, others are still bounded, also on a reused keep-alive connection
+func TestRequestDeadline(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+
+	router := httprouter.New()
+	slow := func(ctx *RequestContext) {
+		for i := 0; i < 6; i++ {
+			ctx.W.Write([]byte("x"))
+			ctx.W.(http.Flusher).Flush()
+			time.Sleep(timeout / 2)
+		}
+	}
+
+	router.GET("/stream", wrapGetHandleInternal(slow, false, true))
+	router.GET("/plain", wrapGetHandleInternal(slow, false, false))
+
+	for _, h2 := range []bool{false, true} {
+		ts := httptest.NewUnstartedServer(router)
+		ts.Config.ReadTimeout = timeout
+		ts.Config.WriteTimeout = timeout
+		ts.EnableHTTP2 = h2
+		ts.StartTLS()
+
+		client := ts.Client()
+		get := func(path string) (string, error) {
+			rsp, err := client.Get(ts.URL + path)
+			if err != nil {
+				return "", err
+			}
+
+			defer rsp.Body.Close()
+			if rsp.ProtoMajor == 2 != h2 {
+				t.Fatal("unexpected proto:", rsp.Proto)
+			}
+
+			b, err := ioutil.ReadAll(rsp.Body)
+			return string(b), err
+		}
+
+		body, err := get("/stream")
+		if err != nil || body != strings.Repeat("x", 6) {
+			t.Fatalf("stream of h2:%v should not time out, got:%q, %v", h2, body, err)
+		}
+
+		// the connection is reused, deadlines are set again by server
+		body, err = get("/plain")
+		if err == nil && body == strings.Repeat("x", 6) {
+			t.Fatalf("plain request of h2:%v should time out", h2)
+		}
+
+		ts.Close()
+	}
+}
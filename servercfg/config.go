@@ -1,6 +1,8 @@
 package servercfg
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"os"
 
@@ -29,18 +31,99 @@ var (
 	XPortWebsocketPath = "/xportws"
 	AuthPath           = "/auth"
 	CfgMonitorPath     = "/cfgmonitor"
-
-	BandwidthKbs = 0
+	AdminPath          = "/admin"
+
+	// XPortHTTPProxyPath reverse proxy into device web by path
+	// {path}/{uuid}/{port}/..., empty means disable
+	XPortHTTPProxyPath = "/dev"
+	// XPortHTTPProxyDomain reverse proxy into device web by host
+	// {uuid}.{domain}, to XPortHTTPProxyPort of device, empty means disable.
+	// Browsers lowercase host, uuid is matched regardless of case on the node holding
+	// the device, but cluster lookup is exact, so devices should use lowercase uuid
+	XPortHTTPProxyDomain = ""
+	XPortHTTPProxyPort   = 80
+
+	// socks5 and http connect proxy listen address, e.g. "127.0.0.1:1080",
+	// empty means disable. They are plain text and client token is sent in clear,
+	// so listen on loopback, or put them behind TLS, e.g. stunnel
+	XPortSocksListen   = ""
+	XPortConnectListen = ""
+
+	// AdminToken bearer token of admin api and grpc DvExport service,
+	// empty means both are disabled
+	AdminToken = ""
+
+	// bandwidth limits in kilobytes per second, 0 means unlimited,
+	// BandwidthKbs is per device limit
+	BandwidthKbs       = 0
+	XPortGlobalKbs     = 0
+	XPortPerRequestKbs = 0
+
+	// xport keepalive, in seconds, 0 means disable. Server pings are off by
+	// default, device firmware that does not answer cmdPing would be dropped
+	// by pong timeout, enable them only if all devices answer; a dead link is
+	// still closed by XPortReadIdleTimeout, as devices ping server
+	XPortPingInterval    = 0
+	XPortPongTimeout     = 10
+	XPortReadIdleTimeout = 90
+
+	// XPortMaxSlots max requests count of a device, cap from device is bounded by it
+	XPortMaxSlots = 1024
+
+	// XPortResumeGrace seconds to keep requests of a broken lws link
+	// for device to resume, 0 means disable
+	XPortResumeGrace = 30
+
+	// xport datagram session idle timeout, in seconds, 0 means disable
+	XPortDgramIdleTimeout = 60
 
 	TokenKey = "@yymmxxkk#$yzilm"
 
+	// XPortClientTokenKey key of xport websocket client token, must differ from TokenKey
+	// and be 16, 24 or 32 bytes, empty means all xport clients are rejected
+	XPortClientTokenKey = ""
+	XPortClients        []*XPortClient
+
+	// TokenKeys keys of device token, tokens are issued with the last one and
+	// verified with any of them, empty means legacy token by TokenKey
+	TokenKeys []*TokenKeyCfg
+	// XPortClientTokenKeys keys of xport client token, like TokenKeys,
+	// empty means legacy token by XPortClientTokenKey
+	XPortClientTokenKeys []*TokenKeyCfg
+	// TokenAcceptLegacy accept legacy tokens although keys configured, for migration
+	TokenAcceptLegacy = false
+
 	FirmwareMap = make(map[string]*FirmwareVersion)
+
+	XPortTCPMaps []*XPortTCPMap
+	XPortUDPMaps []*XPortTCPMap
+
+	// cluster mode, enabled when ClusterAdvertiseURL is not empty, it is the base
+	// url that other nodes use to reach this node, e.g. wss://node1.example.com:8000
+	ClusterAdvertiseURL = ""
+	// ClusterDeviceTTL device route ttl in redis, in seconds
+	ClusterDeviceTTL = 60
+	// ClusterRedirect redirect websocket client to owner node instead of forwarding
+	ClusterRedirect = false
+
+	// XPortPolicies empty means any port of device is reachable
+	XPortPolicies []*XPortPolicy
 )
 
 var (
 	loadedCfgFilePath = ""
+
+	reloadHandlers []ReloadHandle
 )
 
+// ReloadHandle reload handler
+type ReloadHandle func()
+
+// InvokeAfterCfgReloaded register a func called after cfg reloaded
+func InvokeAfterCfgReloaded(fn ReloadHandle) {
+	reloadHandlers = append(reloadHandlers, fn)
+}
+
 // FirmwareVersion firemware config
 type FirmwareVersion struct {
 	Arch          string `json:"arch"`
@@ -50,6 +133,52 @@ type FirmwareVersion struct {
 	NewVersion semver.Version
 }
 
+// TokenKeyCfg key of token, Key is base64 of 16, 24 or 32 bytes,
+// ID in range [1, 255] is carried by token to select the key
+type TokenKeyCfg struct {
+	ID  int    `json:"id"`
+	Key string `json:"key"`
+
+	Secret []byte `json:"-"`
+}
+
+// XPortTCPMap expose a device port as server-side tcp listener,
+// also used by udp mapping, non-empty Host is a target on device's LAN
+type XPortTCPMap struct {
+	Listen string `json:"listen"`
+	UUID   string `json:"uuid"`
+	Host   string `json:"host"`
+	Port   int    `json:"port"`
+}
+
+// XPortClient xport client authorization, "*" in Devices means any device,
+// empty Ports means any port, LANHosts lists LAN targets that client may
+// reach, same format as XPortPolicy.LANHosts, empty means none. e.g.
+//
+//	{"account": "ops", "devices": ["dev-uuid"], "ports": [22]}
+type XPortClient struct {
+	Account  string   `json:"account"`
+	Devices  []string `json:"devices"`
+	Ports    []int    `json:"ports"`
+	LANHosts []string `json:"lan_hosts"`
+}
+
+// XPortPolicy ports that clients may reach on a group of devices,
+// "*" in Devices means any device without its own policy.
+// LANHosts are targets on device's LAN, each is an ip, a cidr, a hostname
+// or "*.suffix", empty means LAN is not reachable; LANPorts empty means any.
+// e.g. to reach a camera and a printer on device's LAN:
+//
+//	"lan_hosts": ["192.168.1.0/24", "*.lan"], "lan_ports": [80, 554, 9100]
+type XPortPolicy struct {
+	Name     string         `json:"name"`
+	Devices  []string       `json:"devices"`
+	Services map[string]int `json:"services"`
+	Ports    []int          `json:"ports"`
+	LANHosts []string       `json:"lan_hosts"`
+	LANPorts []int          `json:"lan_ports"`
+}
+
 // ReLoadConfigFile 重新加载配置
 func ReLoadConfigFile() bool {
 	log.Println("ReLoadConfigFile-----------From File--------:", loadedCfgFilePath)
@@ -59,6 +188,11 @@ func ReLoadConfigFile() bool {
 	}
 
 	log.Println("ReLoadConfigFile-------------------OK")
+
+	for _, fn := range reloadHandlers {
+		fn()
+	}
+
 	return true
 }
 
@@ -78,16 +212,52 @@ func ParseConfigFile(filepath string) bool {
 		XPortLWSPath       string `json:"xport_lwspath"`
 		XPortWebsocketPath string `json:"xport_wspath"`
 
+		XPortHTTPProxyPath   *string `json:"xport_http_proxy_path"`
+		XPortHTTPProxyDomain string  `json:"xport_http_proxy_domain"`
+		XPortHTTPProxyPort   int     `json:"xport_http_proxy_port"`
+
+		XPortSocksListen   string `json:"xport_socks_listen"`
+		XPortConnectListen string `json:"xport_connect_listen"`
+
 		AsHTTPS  bool   `json:"as_https"`
 		AuthPath string `json:"auth_path"`
 
 		CfgMonitorPath string `json:"cfg_monitor_path"`
 
+		AdminPath  string `json:"admin_path"`
+		AdminToken string `json:"admin_token"`
+
 		TokenKey string `json:"token_key"`
 
+		TokenKeys            []*TokenKeyCfg `json:"token_keys"`
+		XPortClientTokenKeys []*TokenKeyCfg `json:"xport_client_token_keys"`
+		TokenAcceptLegacy    bool           `json:"token_accept_legacy"`
+
+		XPortClientTokenKey string         `json:"xport_client_token_key"`
+		XPortClients        []*XPortClient `json:"xport_clients"`
+
 		FirmwareArray []*FirmwareVersion `json:"firmwares"`
 
-		BandwidthKbs int `json:"bandwidth_kbs"`
+		BandwidthKbs       int `json:"bandwidth_kbs"`
+		XPortGlobalKbs     int `json:"xport_global_kbs"`
+		XPortPerRequestKbs int `json:"xport_request_kbs"`
+
+		XPortPingInterval    *int `json:"xport_ping_interval"`
+		XPortPongTimeout     *int `json:"xport_pong_timeout"`
+		XPortReadIdleTimeout *int `json:"xport_read_idle_timeout"`
+
+		XPortDgramIdleTimeout *int `json:"xport_dgram_idle_timeout"`
+		XPortResumeGrace      *int `json:"xport_resume_grace"`
+		XPortMaxSlots         int  `json:"xport_max_slots"`
+
+		XPortTCPMaps []*XPortTCPMap `json:"xport_tcp_maps"`
+		XPortUDPMaps []*XPortTCPMap `json:"xport_udp_maps"`
+
+		XPortPolicies []*XPortPolicy `json:"xport_policies"`
+
+		ClusterAdvertiseURL string `json:"cluster_advertise_url"`
+		ClusterDeviceTTL    int    `json:"cluster_device_ttl"`
+		ClusterRedirect     bool   `json:"cluster_redirect"`
 	}
 
 	loadedCfgFilePath = filepath
@@ -166,6 +336,23 @@ func ParseConfigFile(filepath string) bool {
 		XPortWebsocketPath = params.XPortWebsocketPath
 	}
 
+	if params.XPortHTTPProxyPath != nil {
+		XPortHTTPProxyPath = *params.XPortHTTPProxyPath
+	}
+
+	XPortHTTPProxyDomain = params.XPortHTTPProxyDomain
+	if params.XPortHTTPProxyPort != 0 {
+		if params.XPortHTTPProxyPort < 0 || params.XPortHTTPProxyPort > 65535 {
+			log.Println("xport http proxy port must in range [1, 65535]!")
+			return false
+		}
+
+		XPortHTTPProxyPort = params.XPortHTTPProxyPort
+	}
+
+	XPortSocksListen = params.XPortSocksListen
+	XPortConnectListen = params.XPortConnectListen
+
 	if params.AuthPath != "" {
 		AuthPath = params.AuthPath
 	}
@@ -174,9 +361,91 @@ func ParseConfigFile(filepath string) bool {
 		CfgMonitorPath = params.CfgMonitorPath
 	}
 
+	if params.AdminPath != "" {
+		AdminPath = params.AdminPath
+	}
+
+	AdminToken = params.AdminToken
+
 	BandwidthKbs = params.BandwidthKbs
+	XPortGlobalKbs = params.XPortGlobalKbs
+	XPortPerRequestKbs = params.XPortPerRequestKbs
+
+	if params.XPortPingInterval != nil {
+		XPortPingInterval = *params.XPortPingInterval
+	}
+
+	if params.XPortPongTimeout != nil {
+		XPortPongTimeout = *params.XPortPongTimeout
+	}
+
+	if params.XPortReadIdleTimeout != nil {
+		XPortReadIdleTimeout = *params.XPortReadIdleTimeout
+	}
 	AsHTTPS = params.AsHTTPS
 
+	if params.XPortDgramIdleTimeout != nil {
+		XPortDgramIdleTimeout = *params.XPortDgramIdleTimeout
+	}
+
+	if params.XPortClientTokenKey != "" {
+		if params.XPortClientTokenKey == TokenKey {
+			log.Println("xport client token key must differ from device token key!")
+			return false
+		}
+
+		// legacy key is used as aes key directly
+		l := len(params.XPortClientTokenKey)
+		if l != 16 && l != 24 && l != 32 {
+			log.Printf("xport client token key must be 16, 24 or 32 bytes, got:%d", l)
+			return false
+		}
+
+		XPortClientTokenKey = params.XPortClientTokenKey
+	}
+
+	XPortClients = params.XPortClients
+
+	if !parseTokenKeys(params.TokenKeys) || !parseTokenKeys(params.XPortClientTokenKeys) {
+		return false
+	}
+
+	for _, k := range params.TokenKeys {
+		for _, ck := range params.XPortClientTokenKeys {
+			if bytes.Equal(k.Secret, ck.Secret) {
+				log.Println("xport client token keys must differ from device token keys!")
+				return false
+			}
+		}
+	}
+
+	TokenKeys = params.TokenKeys
+	XPortClientTokenKeys = params.XPortClientTokenKeys
+	TokenAcceptLegacy = params.TokenAcceptLegacy
+
+	if params.XPortResumeGrace != nil {
+		XPortResumeGrace = *params.XPortResumeGrace
+	}
+
+	if params.XPortMaxSlots != 0 {
+		if params.XPortMaxSlots < 0 || params.XPortMaxSlots > 65535 {
+			log.Println("xport max slots must in range [1, 65535]!")
+			return false
+		}
+
+		XPortMaxSlots = params.XPortMaxSlots
+	}
+
+	XPortTCPMaps = params.XPortTCPMaps
+	XPortUDPMaps = params.XPortUDPMaps
+	XPortPolicies = params.XPortPolicies
+
+	ClusterAdvertiseURL = params.ClusterAdvertiseURL
+	ClusterRedirect = params.ClusterRedirect
+	if params.ClusterDeviceTTL > 0 {
+		ClusterDeviceTTL = params.ClusterDeviceTTL
+	}
+
 	if len(params.FirmwareArray) > 0 {
 		for _, f := range params.FirmwareArray {
 			var e error
@@ -193,3 +462,31 @@ func ParseConfigFile(filepath string) bool {
 
 	return true
 }
+
+// parseTokenKeys decode secrets, check ids and key sizes
+func parseTokenKeys(keys []*TokenKeyCfg) bool {
+	ids := make(map[int]bool)
+	for _, k := range keys {
+		if k.ID < 1 || k.ID > 255 || ids[k.ID] {
+			log.Printf("token key id must in range [1, 255] and unique, id:%d", k.ID)
+			return false
+		}
+
+		ids[k.ID] = true
+
+		secret, err := base64.StdEncoding.DecodeString(k.Key)
+		if err != nil {
+			log.Printf("token key %d decode failed:%v", k.ID, err)
+			return false
+		}
+
+		if len(secret) != 16 && len(secret) != 24 && len(secret) != 32 {
+			log.Printf("token key %d must be 16, 24 or 32 bytes, got:%d", k.ID, len(secret))
+			return false
+		}
+
+		k.Secret = secret
+	}
+
+	return true
+}
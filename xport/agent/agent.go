@@ -0,0 +1,365 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"lproxy/xport/lanhost"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Config agent config
+type Config struct {
+	// ServerURL base url of lproxy server, e.g. https://example.com:8000
+	ServerURL string
+	UUID      string
+	Arch      string
+	Version   string
+
+	AuthPath       string
+	CfgMonitorPath string
+	XPortLWSPath   string
+
+	// Cap max requests count, server bounds it by its max slots
+	Cap int
+	// Quota initial flow control quota of each request, 0 means no flow control
+	Quota int
+
+	PingInterval    time.Duration
+	CfgPollInterval time.Duration
+	// ReconnectDelay wait before authenticate again after link broken
+	ReconnectDelay time.Duration
+
+	// Ports local ports that server may dial, empty means any
+	Ports []int
+	// LANHosts hosts on LAN that server may dial, each is an ip, a cidr,
+	// a hostname, "*.suffix" or "*" for any, empty means none
+	LANHosts []string
+
+	InsecureSkipVerify bool
+
+	// NetDial dial connections to server, e.g. lws.PipeListener.Dial in tests,
+	// nil means dial by network
+	NetDial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// CfgResult response of auth and cfg monitor
+type CfgResult struct {
+	Error       int             `json:"error"`
+	Token       string          `json:"token"`
+	Restart     bool            `json:"restart"`
+	NeedUpgrade bool            `json:"need_upgrade"`
+	UpgradeURL  string          `json:"upgrade_url,omitempty"`
+	TunCfg      json.RawMessage `json:"tuncfg,omitempty"`
+}
+
+// Notify notification pushed by server
+type Notify struct {
+	Type    byte
+	Payload []byte
+}
+
+// Agent device side of xport
+type Agent struct {
+	cfg    Config
+	client *http.Client
+
+	// OnCfg called after cfg pulled from server
+	OnCfg func(*CfgResult)
+	// OnNotify called when server pushes a notification
+	OnNotify func(*Notify)
+
+	tokenMutex sync.Mutex
+	token      string
+	domainsVer string
+
+	pollCh chan struct{}
+
+	rpcMutex    sync.Mutex
+	rpcHandlers map[string]RPCHandler
+
+	startedAt time.Time
+	link      *link
+	linkMutex sync.Mutex
+}
+
+// New create agent, empty fields of cfg take the server defaults
+func New(cfg Config) *Agent {
+	if cfg.AuthPath == "" {
+		cfg.AuthPath = "/auth"
+	}
+
+	if cfg.CfgMonitorPath == "" {
+		cfg.CfgMonitorPath = "/cfgmonitor"
+	}
+
+	if cfg.XPortLWSPath == "" {
+		cfg.XPortLWSPath = "/xportlws"
+	}
+
+	if cfg.Cap <= 0 {
+		cfg.Cap = 128
+	}
+
+	if cfg.PingInterval <= 0 {
+		cfg.PingInterval = 30 * time.Second
+	}
+
+	if cfg.CfgPollInterval <= 0 {
+		cfg.CfgPollInterval = 10 * time.Minute
+	}
+
+	if cfg.ReconnectDelay <= 0 {
+		cfg.ReconnectDelay = 5 * time.Second
+	}
+
+	// requests are rare, don't keep idle conns that server may have closed
+	tr := &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify},
+		DisableKeepAlives: true,
+		DialContext:       cfg.NetDial,
+	}
+
+	a := &Agent{
+		cfg:         cfg,
+		client:      &http.Client{Transport: tr, Timeout: 30 * time.Second},
+		pollCh:      make(chan struct{}, 1),
+		rpcHandlers: make(map[string]RPCHandler),
+		startedAt:   time.Now(),
+	}
+
+	a.HandleRPC("status", a.statusRPC)
+	return a
+}
+
+// Run authenticate and keep lws link until ctx done
+func (a *Agent) Run(ctx context.Context) error {
+	go a.pollCfg(ctx)
+
+	for {
+		err := a.runOnce(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		log.Printf("agent link end:%v, reconnect after %s", err, a.cfg.ReconnectDelay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(a.cfg.ReconnectDelay):
+		}
+	}
+}
+
+func (a *Agent) runOnce(ctx context.Context) error {
+	res, err := a.auth()
+	if err != nil {
+		return err
+	}
+
+	a.setToken(res.Token)
+	if a.OnCfg != nil {
+		a.OnCfg(res)
+	}
+
+	l, err := a.dial(ctx, res.Token)
+	if err != nil {
+		return err
+	}
+
+	a.linkMutex.Lock()
+	a.link = l
+	a.linkMutex.Unlock()
+
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.close()
+		case <-stop:
+		}
+	}()
+
+	err = l.serve()
+	close(stop)
+
+	a.linkMutex.Lock()
+	a.link = nil
+	a.linkMutex.Unlock()
+
+	return err
+}
+
+func (a *Agent) setToken(tok string) {
+	a.tokenMutex.Lock()
+	a.token = tok
+	a.tokenMutex.Unlock()
+}
+
+func (a *Agent) getToken() string {
+	a.tokenMutex.Lock()
+	defer a.tokenMutex.Unlock()
+
+	return a.token
+}
+
+func (a *Agent) post(path string, query url.Values, body interface{}) (*CfgResult, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	u := strings.TrimSuffix(a.cfg.ServerURL, "/") + path
+	if query != nil {
+		u = u + "?" + query.Encode()
+	}
+
+	rsp, err := a.client.Post(u, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("post %s failed, status:%d", path, rsp.StatusCode)
+	}
+
+	b, err = ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &CfgResult{}
+	err = json.Unmarshal(b, res)
+	if err != nil {
+		return nil, fmt.Errorf("post %s, unmarshal response failed:%v", path, err)
+	}
+
+	if res.Error != 0 {
+		return nil, fmt.Errorf("post %s, error:%d", path, res.Error)
+	}
+
+	return res, nil
+}
+
+// auth get token from AuthPath
+func (a *Agent) auth() (*CfgResult, error) {
+	req := map[string]string{
+		"uuid":            a.cfg.UUID,
+		"current_version": a.cfg.Version,
+		"arch":            a.cfg.Arch,
+	}
+
+	res, err := a.post(a.cfg.AuthPath, nil, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Token == "" {
+		return nil, fmt.Errorf("auth, no token in response")
+	}
+
+	return res, nil
+}
+
+// PollCfg ask the cfg poll loop to pull cfg now
+func (a *Agent) PollCfg() {
+	select {
+	case a.pollCh <- struct{}{}:
+	default:
+	}
+}
+
+func (a *Agent) pollCfg(ctx context.Context) {
+	ticker := time.NewTicker(a.cfg.CfgPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-a.pollCh:
+		}
+
+		tok := a.getToken()
+		if tok == "" {
+			continue
+		}
+
+		err := a.pullCfg(tok)
+		if err != nil {
+			log.Println("agent pull cfg failed:", err)
+		}
+	}
+}
+
+func (a *Agent) pullCfg(tok string) error {
+	req := map[string]string{
+		"current_version": a.cfg.Version,
+		"arch":            a.cfg.Arch,
+		"domains_ver":     a.domainsVer,
+	}
+
+	query := url.Values{}
+	query.Set("tok", tok)
+	res, err := a.post(a.cfg.CfgMonitorPath, query, req)
+	if err != nil {
+		return err
+	}
+
+	if len(res.TunCfg) > 0 {
+		tc := struct {
+			DomainsVer string `json:"domains_ver"`
+		}{}
+		if json.Unmarshal(res.TunCfg, &tc) == nil && tc.DomainsVer != "" {
+			a.domainsVer = tc.DomainsVer
+		}
+	}
+
+	if a.OnCfg != nil {
+		a.OnCfg(res)
+	}
+
+	return nil
+}
+
+func (a *Agent) onNotify(n *Notify) {
+	log.Printf("agent notify, type:%d, payload:%s", n.Type, n.Payload)
+	if n.Type == NotifyCfgChanged {
+		a.PollCfg()
+	}
+
+	if a.OnNotify != nil {
+		a.OnNotify(n)
+	}
+}
+
+func (a *Agent) hostAllowed(host string) bool {
+	return lanhost.Match(a.cfg.LANHosts, host)
+}
+
+func (a *Agent) portAllowed(port uint16) bool {
+	if len(a.cfg.Ports) == 0 {
+		return true
+	}
+
+	for _, p := range a.cfg.Ports {
+		if p == int(port) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,958 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"lproxy/server"
+	"lproxy/servercfg"
+	xport "lproxy/xport"
+	"lproxy/xport/lws"
+	"lproxy/xport/xporttest"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	testClientKey = "agent#test#ckey!"
+)
+
+// startServer serve xport on in-memory listener
+func startServer() (*httptest.Server, *lws.PipeListener) {
+	return xporttest.StartServer(func() {
+		servercfg.XPortHTTPProxyDomain = "dev.test"
+		servercfg.XPortSocksListen = xporttest.FreeAddr()
+		servercfg.XPortConnectListen = xporttest.FreeAddr()
+		// server pings are off by default, agent answers them
+		servercfg.XPortPingInterval = 1
+	})
+}
+
+func startEcho(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("echo listen:", err)
+	}
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				io.Copy(c, c)
+				c.(*net.TCPConn).CloseWrite()
+			}()
+		}
+	}()
+
+	return ln
+}
+
+// setClient allow client "alice" to reach devices, return func to restore
+func setClient(devices ...string) func() {
+	key, clients := servercfg.XPortClientTokenKey, servercfg.XPortClients
+	servercfg.XPortClientTokenKey = testClientKey
+	servercfg.XPortClients = []*servercfg.XPortClient{{Account: "alice", Devices: devices}}
+
+	return func() {
+		servercfg.XPortClientTokenKey, servercfg.XPortClients = key, clients
+	}
+}
+
+func waitOnline(t *testing.T, uuid string) *xport.XDevice {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d := xport.GetDeviceRegistry().Get(uuid)
+		if d != nil {
+			return d
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("device not online")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// echoThrough send data to the listen address of a tcp mapping, and expect
+// it echoed back
+func echoThrough(t *testing.T, listen string, data []byte) {
+	c, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal("dial mapping:", err)
+	}
+
+	defer c.Close()
+
+	go func() {
+		c.Write(data)
+		c.(*net.TCPConn).CloseWrite()
+	}()
+
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal("read echo:", err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Fatalf("echo mismatch, got:%d, want:%d", len(got), len(data))
+	}
+}
+
+func TestAgentEndToEnd(t *testing.T) {
+	ts, l := startServer()
+
+	echo := startEcho(t)
+	defer echo.Close()
+
+	uuid := fmt.Sprintf("agent-test-%d", time.Now().UnixNano())
+	a := New(Config{
+		ServerURL:    ts.URL,
+		UUID:         uuid,
+		Version:      "0.1.0",
+		Quota:        64 * 1024,
+		PingInterval: time.Second,
+		NetDial:      l.Dial,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+
+	waitOnline(t, uuid)
+	registry := xport.GetDeviceRegistry()
+
+	// rpc
+	st := &Status{}
+	err := registry.Call(ctx, uuid, "status", nil, st)
+	if err != nil || st.UUID != uuid {
+		t.Fatal("rpc status:", st, err)
+	}
+
+	err = registry.Call(ctx, uuid, "no-such-method", nil, nil)
+	if _, ok := err.(*xport.RPCError); !ok {
+		t.Fatal("rpc unknown method should fail with RPCError, got:", err)
+	}
+
+	// tcp mapping to the echo port of device
+	listen := xporttest.FreeAddr()
+	echoPort := echo.Addr().(*net.TCPAddr).Port
+	err = xport.AddTCPMapping(listen, uuid, uint16(echoPort))
+	if err != nil {
+		t.Fatal("add tcp mapping:", err)
+	}
+
+	defer xport.RemoveTCPMapping(listen)
+
+	echoThrough(t, listen, bytes.Repeat([]byte("0123456789abcdef"), 32*1024))
+}
+
+// TestAgentServerPing device that answers server pings gets rtt measured
+func TestAgentServerPing(t *testing.T) {
+	ts, l := startServer()
+
+	uuid := fmt.Sprintf("agent-ping-%d", time.Now().UnixNano())
+	a := New(Config{
+		ServerURL:    ts.URL,
+		UUID:         uuid,
+		PingInterval: time.Second,
+		NetDial:      l.Dial,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+
+	d := waitOnline(t, uuid)
+	deadline := time.Now().Add(5 * time.Second)
+	for d.RTT() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("rtt should be measured by server ping")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestAgentRPC server side of rpc, timeout, late response and device gone
+func TestAgentRPC(t *testing.T) {
+	ts, l := startServer()
+
+	uuid := fmt.Sprintf("agent-rpc-%d", time.Now().UnixNano())
+	a := New(Config{
+		ServerURL:    ts.URL,
+		UUID:         uuid,
+		PingInterval: time.Second,
+		NetDial:      l.Dial,
+	})
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	defer close(release)
+	a.HandleRPC("block", func(codec byte, args []byte) (interface{}, error) {
+		started <- struct{}{}
+		<-release
+		return nil, nil
+	})
+
+	a.HandleRPC("slow", func(codec byte, args []byte) (interface{}, error) {
+		time.Sleep(300 * time.Millisecond)
+		return "late", nil
+	})
+
+	a.HandleRPC("echo", func(codec byte, args []byte) (interface{}, error) {
+		var s string
+		err := json.Unmarshal(args, &s)
+		return s, err
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+
+	d := waitOnline(t, uuid)
+	registry := xport.GetDeviceRegistry()
+
+	err := registry.Call(ctx, "no-such-dev", "status", nil, nil)
+	if err == nil {
+		t.Fatal("rpc to offline device should fail")
+	}
+
+	// timeout, the late response is dropped as unknown call
+	tctx, tcancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer tcancel()
+	var reply string
+	err = d.Call(tctx, "slow", nil, &reply)
+	if err == nil || !strings.Contains(err.Error(), "deadline exceeded") || reply != "" {
+		t.Fatal("rpc should time out, got:", reply, err)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	st := &Status{}
+	err = d.Call(ctx, "status", nil, st)
+	if err != nil || st.UUID != uuid {
+		t.Fatal("rpc after late response:", st, err)
+	}
+
+	// extended length link carries args beyond 64k
+	large := strings.Repeat("x", 100*1024)
+	err = d.Call(ctx, "echo", large, &reply)
+	if err != nil || reply != large {
+		t.Fatal("rpc large args:", len(reply), err)
+	}
+
+	// device of notify version does not know rpc
+	base := fmt.Sprintf("agent-rpc-base-%d", time.Now().UnixNano())
+	u := "ws" + strings.TrimPrefix(ts.URL, "http") + servercfg.XPortLWSPath +
+		"?cap=1&ver=2&tok=" + url.QueryEscape(server.GenTK(base))
+	dialer := &lws.Dialer{NetDial: l.Dial, HandshakeTimeout: 5 * time.Second}
+	c, _, err := dialer.DialContext(ctx, u, nil)
+	if err != nil {
+		t.Fatal("dial lws:", err)
+	}
+
+	defer c.Close()
+	err = waitOnline(t, base).Call(ctx, "status", nil, nil)
+	if err != xport.ErrRPCUnsupported {
+		t.Fatal("rpc to device without rpc version should be unsupported, got:", err)
+	}
+
+	// device gone in the middle of a call
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- d.Call(ctx, "block", nil, nil)
+	}()
+
+	<-started
+	d.Kick()
+
+	select {
+	case err = <-errCh:
+		if err == nil {
+			t.Fatal("rpc should fail when device gone")
+		}
+
+		if _, ok := err.(*xport.RPCError); ok {
+			t.Fatal("device gone should not be a device error:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("rpc should return when device gone")
+	}
+
+	err = d.Call(ctx, "status", nil, nil)
+	if err == nil {
+		t.Fatal("rpc on ended device should fail")
+	}
+}
+
+// TestAgentSlowClient a stalled client holds back only its own request,
+// others of the device keep flowing, and no data is lost
+func TestAgentSlowClient(t *testing.T) {
+	ts, l := startServer()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1024*1024)
+	src, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("source listen:", err)
+	}
+
+	defer src.Close()
+	go func() {
+		c, err := src.Accept()
+		if err != nil {
+			return
+		}
+
+		c.Write(data)
+		c.Close()
+	}()
+
+	echo := startEcho(t)
+	defer echo.Close()
+
+	uuid := fmt.Sprintf("agent-slow-%d", time.Now().UnixNano())
+	a := New(Config{
+		ServerURL:    ts.URL,
+		UUID:         uuid,
+		PingInterval: time.Second,
+		NetDial:      l.Dial,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	waitOnline(t, uuid)
+
+	listen := xporttest.FreeAddr()
+	err = xport.AddTCPMapping(listen, uuid, uint16(src.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatal("add tcp mapping:", err)
+	}
+
+	defer xport.RemoveTCPMapping(listen)
+
+	echoListen := xporttest.FreeAddr()
+	err = xport.AddTCPMapping(echoListen, uuid, uint16(echo.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatal("add tcp mapping:", err)
+	}
+
+	defer xport.RemoveTCPMapping(echoListen)
+
+	c, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal("dial mapping:", err)
+	}
+
+	defer c.Close()
+
+	// client does not read, let its queues fill up
+	time.Sleep(time.Second)
+
+	// fails on read timeout if the stalled client blocks the device
+	echoThrough(t, echoListen, bytes.Repeat([]byte("fedcba9876543210"), 64*1024))
+
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got, err := ioutil.ReadAll(c)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("slow client read:%d, want:%d, err:%v", len(got), len(data), err)
+	}
+}
+
+// TestAgentDeviceBandwidth a shaped device still answers control messages
+// in time, shaping holds back its requests rather than the link
+func TestAgentDeviceBandwidth(t *testing.T) {
+	ts, l := startServer()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	src, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("source listen:", err)
+	}
+
+	defer src.Close()
+	go func() {
+		c, err := src.Accept()
+		if err != nil {
+			return
+		}
+
+		c.Write(data)
+		c.Close()
+	}()
+
+	uuid := fmt.Sprintf("agent-kbs-%d", time.Now().UnixNano())
+	xport.SetDeviceBandwidth(uuid, 256)
+
+	a := New(Config{
+		ServerURL:    ts.URL,
+		UUID:         uuid,
+		PingInterval: time.Second,
+		NetDial:      l.Dial,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	d := waitOnline(t, uuid)
+
+	listen := xporttest.FreeAddr()
+	err = xport.AddTCPMapping(listen, uuid, uint16(src.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatal("add tcp mapping:", err)
+	}
+
+	defer xport.RemoveTCPMapping(listen)
+
+	c, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal("dial mapping:", err)
+	}
+
+	defer c.Close()
+
+	got := make(chan []byte, 1)
+	go func() {
+		c.SetReadDeadline(time.Now().Add(10 * time.Second))
+		b, _ := ioutil.ReadAll(c)
+		got <- b
+	}()
+
+	// 1m at 256k/s takes seconds, the link is not throttled meanwhile
+	time.Sleep(500 * time.Millisecond)
+	tctx, tcancel := context.WithTimeout(ctx, time.Second)
+	defer tcancel()
+	err = d.Call(tctx, "status", nil, nil)
+	if err != nil {
+		t.Fatal("rpc to shaped device:", err)
+	}
+
+	b := <-got
+	if !bytes.Equal(b, data) {
+		t.Fatalf("shaped read:%d, want:%d", len(b), len(data))
+	}
+}
+
+func TestAgentLANHost(t *testing.T) {
+	ts, l := startServer()
+
+	echo := startEcho(t)
+	defer echo.Close()
+
+	uuid := fmt.Sprintf("agent-lan-%d", time.Now().UnixNano())
+	policies := servercfg.XPortPolicies
+	servercfg.XPortPolicies = []*servercfg.XPortPolicy{{
+		Name:     "lan",
+		Devices:  []string{uuid},
+		LANHosts: []string{"127.0.0.0/8", "*.lan"},
+	}}
+	defer func() { servercfg.XPortPolicies = policies }()
+
+	a := New(Config{
+		ServerURL:    ts.URL,
+		UUID:         uuid,
+		PingInterval: time.Second,
+		LANHosts:     []string{"127.0.0.1"},
+		NetDial:      l.Dial,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+
+	d := waitOnline(t, uuid)
+	if d.Version() != 5 {
+		t.Fatal("protocol version should be negotiated, got:", d.Version())
+	}
+
+	echoPort := uint16(echo.Addr().(*net.TCPAddr).Port)
+	err := xport.AddTCPHostMapping("127.0.0.1:0", uuid, "10.0.0.1", echoPort)
+	if err == nil {
+		t.Fatal("host not in policy should be rejected")
+	}
+
+	listen := xporttest.FreeAddr()
+	err = xport.AddTCPHostMapping(listen, uuid, "127.0.0.1", echoPort)
+	if err != nil {
+		t.Fatal("add tcp host mapping:", err)
+	}
+
+	defer xport.RemoveTCPMapping(listen)
+
+	echoThrough(t, listen, []byte("hello lan"))
+
+	// allowed by server but not by agent, agent closes the request
+	denied := xporttest.FreeAddr()
+	err = xport.AddTCPHostMapping(denied, uuid, "127.0.0.2", echoPort)
+	if err != nil {
+		t.Fatal("add tcp host mapping:", err)
+	}
+
+	defer xport.RemoveTCPMapping(denied)
+
+	c, err := net.Dial("tcp", denied)
+	if err != nil {
+		t.Fatal("dial mapping:", err)
+	}
+
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = c.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatal("request to denied host should be closed, got:", err)
+	}
+}
+
+// startDeviceWeb a device web that redirects to login page and sets cookie,
+// with a websocket echo
+func startDeviceWeb(t *testing.T) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "sid", Value: "1", Path: "/", Domain: "127.0.0.1"})
+		http.Redirect(w, r, "/login?next=%2Fa%20b", http.StatusFound)
+	})
+
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		_, err := r.Cookie("xport_ctok")
+		leak := err == nil || r.Header.Get("Authorization") != ""
+		fmt.Fprintf(w, "login host:%s query:%s leak:%v", r.Host, r.URL.RawQuery, leak)
+	})
+
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		defer c.Close()
+		mt, message, err := c.ReadMessage()
+		if err == nil {
+			c.WriteMessage(mt, message)
+		}
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func TestAgentHTTPProxy(t *testing.T) {
+	ts, l := startServer()
+
+	web := startDeviceWeb(t)
+	defer web.Close()
+
+	uuid := fmt.Sprintf("Agent-HTTP-%d", time.Now().UnixNano())
+	defer setClient(uuid)()
+
+	a := New(Config{
+		ServerURL:    ts.URL,
+		UUID:         uuid,
+		PingInterval: time.Second,
+		NetDial:      l.Dial,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	waitOnline(t, uuid)
+
+	client := &http.Client{
+		Transport: &http.Transport{DialContext: l.Dial},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	port := web.Listener.Addr().(*net.TCPAddr).Port
+	prefix := fmt.Sprintf("%s/dev/%s/%d", ts.URL, uuid, port)
+	rsp, err := client.Get(prefix + "/")
+	if err != nil || rsp.StatusCode != http.StatusUnauthorized {
+		t.Fatal("request without token should be rejected:", rsp, err)
+	}
+
+	// token in query is moved to cookie
+	ctok := server.GenClientTK("alice")
+	rsp, err = client.Get(prefix + "/?ctok=" + ctok)
+	if err != nil || rsp.StatusCode != http.StatusFound || rsp.Header.Get("Location") != "/dev/"+uuid+"/"+strconv.Itoa(port)+"/" {
+		t.Fatal("token in query should be redirected:", rsp, err)
+	}
+
+	cookie := rsp.Cookies()[0]
+	if cookie.Name != "xport_ctok" || cookie.Path != fmt.Sprintf("/dev/%s/%d/", uuid, port) {
+		t.Fatal("token cookie:", cookie)
+	}
+
+	req, _ := http.NewRequest("GET", prefix+"/", nil)
+	req.AddCookie(cookie)
+	rsp, err = client.Do(req)
+	if err != nil || rsp.StatusCode != http.StatusFound {
+		t.Fatal("proxy to device web:", rsp, err)
+	}
+
+	want := fmt.Sprintf("/dev/%s/%d/login?next=%%2Fa%%20b", uuid, port)
+	if rsp.Header.Get("Location") != want {
+		t.Fatal("location should be rewritten, got:", rsp.Header.Get("Location"))
+	}
+
+	sid := rsp.Cookies()[0]
+	if sid.Path != fmt.Sprintf("/dev/%s/%d/", uuid, port) || sid.Domain != "" {
+		t.Fatal("cookie should be rewritten, got:", sid)
+	}
+
+	req, _ = http.NewRequest("GET", prefix+"/login?next=%2Fa%20b", nil)
+	req.AddCookie(cookie)
+	rsp, err = client.Do(req)
+	if err != nil {
+		t.Fatal("proxy to device web:", err)
+	}
+
+	body, _ := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	want = fmt.Sprintf("login host:127.0.0.1:%d query:next=%%2Fa%%20b leak:false", port)
+	if string(body) != want {
+		t.Fatal("device web response:", string(body))
+	}
+
+	// host mode, token in header, browsers lowercase host
+	servercfg.XPortHTTPProxyPort = port
+	defer func() { servercfg.XPortHTTPProxyPort = 80 }()
+
+	req, _ = http.NewRequest("GET", ts.URL+"/login", nil)
+	req.Host = strings.ToLower(uuid) + ".dev.test"
+	req.Header.Set("Authorization", "Bearer "+ctok)
+	rsp, err = client.Do(req)
+	if err != nil {
+		t.Fatal("proxy to device web by host:", err)
+	}
+
+	body, _ = ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	want = fmt.Sprintf("login host:127.0.0.1:%d query: leak:false", port)
+	if string(body) != want {
+		t.Fatal("device web response by host:", string(body))
+	}
+
+	// websocket upgrade
+	d := &websocket.Dialer{NetDial: func(network, addr string) (net.Conn, error) {
+		return l.Dial(context.Background(), network, addr)
+	}}
+
+	wsURL := "ws" + strings.TrimPrefix(prefix, "http") + "/ws?ctok=" + ctok
+	c, _, err := d.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal("websocket through proxy:", err)
+	}
+
+	defer c.Close()
+	c.WriteMessage(websocket.TextMessage, []byte("hello ws"))
+	_, message, err := c.ReadMessage()
+	if err != nil || string(message) != "hello ws" {
+		t.Fatal("websocket echo:", string(message), err)
+	}
+}
+
+// socksConnect socks5 handshake with username/password, return reply code
+func socksConnect(t *testing.T, c net.Conn, user string, password string, host string, port int) byte {
+	c.Write([]byte{5, 1, 2})
+	buf := make([]byte, 10)
+	_, err := io.ReadFull(c, buf[:2])
+	if err != nil || buf[1] != 2 {
+		t.Fatal("socks5 method:", buf[:2], err)
+	}
+
+	auth := []byte{1, byte(len(user))}
+	auth = append(auth, user...)
+	auth = append(auth, byte(len(password)))
+	auth = append(auth, password...)
+	c.Write(auth)
+	_, err = io.ReadFull(c, buf[:2])
+	if err != nil {
+		t.Fatal("socks5 auth:", err)
+	}
+
+	if buf[1] != 0 {
+		return 0xff
+	}
+
+	req := []byte{5, 1, 0, 3, byte(len(host))}
+	req = append(req, host...)
+	req = append(req, byte(port>>8), byte(port))
+	c.Write(req)
+	_, err = io.ReadFull(c, buf)
+	if err != nil {
+		t.Fatal("socks5 connect:", err)
+	}
+
+	return buf[1]
+}
+
+func TestAgentProxyFrontEnds(t *testing.T) {
+	ts, l := startServer()
+
+	echo := startEcho(t)
+	defer echo.Close()
+
+	uuid := fmt.Sprintf("agent-proxy-%d", time.Now().UnixNano())
+	defer setClient(uuid, "no-such-dev")()
+
+	a := New(Config{
+		ServerURL:    ts.URL,
+		UUID:         uuid,
+		PingInterval: time.Second,
+		NetDial:      l.Dial,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	waitOnline(t, uuid)
+
+	ctok := server.GenClientTK("alice")
+	echoPort := echo.Addr().(*net.TCPAddr).Port
+	dest := uuid + ".xport"
+
+	// socks5
+	c, err := net.Dial("tcp", servercfg.XPortSocksListen)
+	if err != nil {
+		t.Fatal("dial socks5:", err)
+	}
+
+	defer c.Close()
+	if rep := socksConnect(t, c, "", "bad token", dest, echoPort); rep != 0xff {
+		t.Fatal("socks5 with bad token should fail, rep:", rep)
+	}
+
+	c, err = net.Dial("tcp", servercfg.XPortSocksListen)
+	if err != nil {
+		t.Fatal("dial socks5:", err)
+	}
+
+	defer c.Close()
+	if rep := socksConnect(t, c, "", ctok, "no-such-dev.xport", echoPort); rep != 4 {
+		t.Fatal("socks5 to offline device should fail, rep:", rep)
+	}
+
+	c, err = net.Dial("tcp", servercfg.XPortSocksListen)
+	if err != nil {
+		t.Fatal("dial socks5:", err)
+	}
+
+	defer c.Close()
+	if rep := socksConnect(t, c, uuid, ctok, "localhost", echoPort); rep != 0 {
+		t.Fatal("socks5 connect failed, rep:", rep)
+	}
+
+	c.Write([]byte("hello socks"))
+	c.(*net.TCPConn).CloseWrite()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := ioutil.ReadAll(c)
+	if err != nil || string(got) != "hello socks" {
+		t.Fatal("socks5 echo:", string(got), err)
+	}
+
+	// http connect
+	c, err = net.Dial("tcp", servercfg.XPortConnectListen)
+	if err != nil {
+		t.Fatal("dial http connect:", err)
+	}
+
+	defer c.Close()
+	fmt.Fprintf(c, "CONNECT %s:%d HTTP/1.1\r\nHost: %s:%d\r\n\r\n", dest, echoPort, dest, echoPort)
+	rsp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil || rsp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatal("http connect without token should fail:", rsp, err)
+	}
+
+	c, err = net.Dial("tcp", servercfg.XPortConnectListen)
+	if err != nil {
+		t.Fatal("dial http connect:", err)
+	}
+
+	defer c.Close()
+	basic := base64.StdEncoding.EncodeToString([]byte("alice:" + ctok))
+	fmt.Fprintf(c, "CONNECT %s:%d HTTP/1.1\r\nHost: %s:%d\r\nProxy-Authorization: Basic %s\r\n\r\nhello connect",
+		dest, echoPort, dest, echoPort, basic)
+	br := bufio.NewReader(c)
+	rsp, err = http.ReadResponse(br, nil)
+	if err != nil || rsp.StatusCode != http.StatusOK {
+		t.Fatal("http connect failed:", rsp, err)
+	}
+
+	c.(*net.TCPConn).CloseWrite()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err = ioutil.ReadAll(br)
+	if err != nil || string(got) != "hello connect" {
+		t.Fatal("http connect echo:", string(got), err)
+	}
+}
+
+func TestAgentProxyNoSlot(t *testing.T) {
+	ts, l := startServer()
+
+	echo := startEcho(t)
+	defer echo.Close()
+
+	uuid := fmt.Sprintf("agent-noslot-%d", time.Now().UnixNano())
+	defer setClient(uuid)()
+
+	a := New(Config{
+		ServerURL:    ts.URL,
+		UUID:         uuid,
+		Cap:          1,
+		PingInterval: time.Second,
+		NetDial:      l.Dial,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	waitOnline(t, uuid)
+
+	ctok := server.GenClientTK("alice")
+	echoPort := echo.Addr().(*net.TCPAddr).Port
+	dest := uuid + ".xport"
+
+	// the only slot is held
+	c, err := net.Dial("tcp", servercfg.XPortSocksListen)
+	if err != nil {
+		t.Fatal("dial socks5:", err)
+	}
+
+	defer c.Close()
+	if rep := socksConnect(t, c, "", ctok, dest, echoPort); rep != 0 {
+		t.Fatal("socks5 connect failed, rep:", rep)
+	}
+
+	// mount failure is replied instead of success
+	c, err = net.Dial("tcp", servercfg.XPortSocksListen)
+	if err != nil {
+		t.Fatal("dial socks5:", err)
+	}
+
+	defer c.Close()
+	if rep := socksConnect(t, c, "", ctok, dest, echoPort); rep != 1 {
+		t.Fatal("socks5 without free slot should fail, rep:", rep)
+	}
+
+	c, err = net.Dial("tcp", servercfg.XPortConnectListen)
+	if err != nil {
+		t.Fatal("dial http connect:", err)
+	}
+
+	defer c.Close()
+	fmt.Fprintf(c, "CONNECT %s:%d HTTP/1.1\r\nHost: %s:%d\r\nProxy-Authorization: Bearer %s\r\n\r\n",
+		dest, echoPort, dest, echoPort, ctok)
+	rsp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil || rsp.StatusCode != http.StatusBadGateway {
+		t.Fatal("http connect without free slot should fail:", rsp, err)
+	}
+}
+
+// TestAgentWebsocketHalfClose empty message is write-shutdown only with
+// halfclose=1, otherwise it is ignored
+func TestAgentWebsocketHalfClose(t *testing.T) {
+	ts, l := startServer()
+
+	echo := startEcho(t)
+	defer echo.Close()
+
+	uuid := fmt.Sprintf("agent-halfclose-%d", time.Now().UnixNano())
+	defer setClient(uuid)()
+
+	a := New(Config{
+		ServerURL:    ts.URL,
+		UUID:         uuid,
+		PingInterval: time.Second,
+		NetDial:      l.Dial,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	waitOnline(t, uuid)
+
+	d := &websocket.Dialer{NetDial: func(network, addr string) (net.Conn, error) {
+		return l.Dial(context.Background(), network, addr)
+	}}
+
+	query := url.Values{}
+	query.Set("uuid", uuid)
+	query.Set("port", strconv.Itoa(echo.Addr().(*net.TCPAddr).Port))
+	query.Set("ctok", server.GenClientTK("alice"))
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + servercfg.XPortWebsocketPath + "?"
+
+	// keepalive-style empty message in the middle of stream
+	c, _, err := d.Dial(wsURL+query.Encode(), nil)
+	if err != nil {
+		t.Fatal("dial websocket:", err)
+	}
+
+	defer c.Close()
+	c.WriteMessage(websocket.BinaryMessage, []byte("a"))
+	c.WriteMessage(websocket.BinaryMessage, []byte{})
+	c.WriteMessage(websocket.BinaryMessage, []byte("b"))
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var got []byte
+	for len(got) < 2 {
+		_, message, err := c.ReadMessage()
+		if err != nil || len(message) == 0 {
+			t.Fatalf("empty message should be ignored, got:%q, %v", got, err)
+		}
+
+		got = append(got, message...)
+	}
+
+	if string(got) != "ab" {
+		t.Fatal("websocket echo:", string(got))
+	}
+
+	// FIN goes both ways
+	query.Set("halfclose", "1")
+	c, _, err = d.Dial(wsURL+query.Encode(), nil)
+	if err != nil {
+		t.Fatal("dial websocket:", err)
+	}
+
+	defer c.Close()
+	c.WriteMessage(websocket.BinaryMessage, []byte("hello"))
+	c.WriteMessage(websocket.BinaryMessage, []byte{})
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got = got[:0]
+	for {
+		_, message, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal("read websocket:", err)
+		}
+
+		if len(message) == 0 {
+			break
+		}
+
+		got = append(got, message...)
+	}
+
+	if string(got) != "hello" {
+		t.Fatal("websocket echo before FIN:", string(got))
+	}
+}
@@ -0,0 +1,347 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"lproxy/xport/lws"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// commands of xport, see lproxy/xport
+const (
+	cmdReqData           = 1
+	cmdReqCreated        = 2
+	cmdReqClientClosed   = 3
+	cmdReqClientFinished = 4
+	cmdReqServerFinished = 5
+	cmdReqServerClosed   = 6
+	cmdReqClientQuota    = 7
+	cmdPing              = 8
+	cmdPong              = 9
+	cmdReqDgramCreated   = 10
+	cmdReqDgram          = 11
+	cmdSessionInfo       = 12
+	cmdReqAck            = 13
+	// since protocolVersion 2
+	cmdNotify = 14
+	// since protocolVersion 3
+	cmdRPCRequest  = 15
+	cmdRPCResponse = 16
+	// since protocolVersion 4
+	cmdReqHostCreated      = 17
+	cmdReqHostDgramCreated = 18
+	// since protocolVersion 5
+	cmdReqServerQuota = 19
+)
+
+const (
+	// protocolVersion highest xport protocol version agent supports
+	protocolVersion = 5
+	versionHeader   = "Xport-Version"
+
+	// address types in cmdReqHostCreated
+	lanHostIPv4 = 1
+	lanHostName = 3
+	lanHostIPv6 = 4
+)
+
+// types of Notify, see lproxy/xport
+const (
+	// NotifyCfgChanged agent pulls cfg again by itself
+	NotifyCfgChanged = 1
+	// NotifyRestart device should restart
+	NotifyRestart = 2
+	// NotifyUpgrade new firmware is available
+	NotifyUpgrade = 3
+)
+
+// link lws link to server
+type link struct {
+	a *Agent
+	c *lws.Conn
+	// negotiated protocol version
+	version int
+
+	reqMutex sync.Mutex
+	requests map[uint16]*request
+}
+
+// dial connect to XPortLWSPath
+func (a *Agent) dial(ctx context.Context, tok string) (*link, error) {
+	u, err := url.Parse(strings.TrimSuffix(a.cfg.ServerURL, "/") + a.cfg.XPortLWSPath)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("tok", tok)
+	query.Set("cap", strconv.Itoa(a.cfg.Cap))
+	query.Set("ver", strconv.Itoa(protocolVersion))
+
+	if a.cfg.Quota > 0 {
+		query.Set("quota", strconv.Itoa(a.cfg.Quota))
+	}
+
+	u.RawQuery = query.Encode()
+
+	d := &lws.Dialer{
+		NetDial:          a.cfg.NetDial,
+		TLSClientConfig:  &tls.Config{InsecureSkipVerify: a.cfg.InsecureSkipVerify},
+		HandshakeTimeout: 10 * time.Second,
+		ExtendedLength:   true,
+	}
+
+	c, rsp, err := d.DialContext(ctx, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// old server does not reply version
+	version, err := strconv.Atoi(rsp.Header.Get(versionHeader))
+	if err != nil {
+		version = 1
+	}
+
+	log.Printf("agent lws link connected to:%s, version:%d", u.Host, version)
+	return &link{a: a, c: c, version: version, requests: make(map[uint16]*request)}, nil
+}
+
+func (l *link) close() {
+	l.c.Close()
+}
+
+// send log error, link broken will be found by read loop
+func (l *link) send(msg []byte) {
+	err := l.c.WriteMessage(msg)
+	if err != nil {
+		log.Println("agent send failed:", err)
+	}
+}
+
+func (l *link) keepalive(done chan struct{}) {
+	ticker := time.NewTicker(l.a.cfg.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			msg := make([]byte, 9)
+			msg[0] = cmdPing
+			binary.LittleEndian.PutUint64(msg[1:], uint64(time.Now().UnixNano()))
+			l.send(msg)
+		}
+	}
+}
+
+// serve read messages until link broken
+func (l *link) serve() error {
+	done := make(chan struct{})
+	go l.keepalive(done)
+
+	defer func() {
+		close(done)
+		l.close()
+		l.closeAll()
+	}()
+
+	for {
+		// server answers every ping, so link is dead if nothing read in 3 intervals
+		l.c.SetReadDeadline(time.Now().Add(3 * l.a.cfg.PingInterval))
+		message, err := l.c.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		if len(message) < 1 {
+			continue
+		}
+
+		switch message[0] {
+		case cmdPing:
+			message[0] = cmdPong
+			l.send(message)
+		case cmdPong, cmdSessionInfo:
+			// agent does not resume session
+		case cmdNotify:
+			if len(message) < 2 {
+				continue
+			}
+
+			l.a.onNotify(&Notify{Type: message[1], Payload: message[2:]})
+		case cmdRPCRequest:
+			go l.a.onRPCRequest(l, message)
+		default:
+			l.handleRequestMsg(message)
+		}
+	}
+}
+
+func (l *link) handleRequestMsg(message []byte) {
+	if len(message) < 5 {
+		log.Errorln("agent request message len should >= 5")
+		return
+	}
+
+	cmd := message[0]
+	idx := binary.LittleEndian.Uint16(message[1:])
+	tag := binary.LittleEndian.Uint16(message[3:])
+
+	if cmd == cmdReqCreated || cmd == cmdReqDgramCreated {
+		if len(message) < 7 {
+			log.Errorln("agent create message len should >= 7")
+			return
+		}
+
+		port := binary.LittleEndian.Uint16(message[5:])
+		l.createRequest(idx, tag, "", port, cmd == cmdReqDgramCreated)
+		return
+	}
+
+	if cmd == cmdReqHostCreated || cmd == cmdReqHostDgramCreated {
+		if len(message) < 8 {
+			log.Errorln("agent host create message len should >= 8")
+			return
+		}
+
+		port := binary.LittleEndian.Uint16(message[5:])
+		host, ok := parseLANHost(message[7:])
+		if !ok {
+			log.Errorln("agent host create message with invalid address")
+			return
+		}
+
+		l.createRequest(idx, tag, host, port, cmd == cmdReqHostDgramCreated)
+		return
+	}
+
+	req := l.getRequest(idx, tag)
+	if req == nil {
+		if cmd != cmdReqAck && cmd != cmdReqClientClosed && cmd != cmdReqServerQuota {
+			log.Printf("agent no request found for idx:%d tag:%d", idx, tag)
+		}
+		return
+	}
+
+	switch cmd {
+	case cmdReqData, cmdReqDgram:
+		req.push(message[5:])
+	case cmdReqClientFinished:
+		req.push(nil)
+	case cmdReqClientClosed:
+		req.close(false)
+	case cmdReqServerQuota:
+		if len(message) < 9 {
+			log.Errorln("agent server quota message len should >= 9")
+			return
+		}
+
+		req.onServerQuota(binary.LittleEndian.Uint32(message[5:]))
+	case cmdReqAck:
+	default:
+		log.Println("agent unknown cmd:", cmd)
+	}
+}
+
+// parseLANHost decode address of cmdReqHostCreated
+func parseLANHost(addr []byte) (string, bool) {
+	switch addr[0] {
+	case lanHostIPv4:
+		if len(addr) != 1+net.IPv4len {
+			return "", false
+		}
+
+		return net.IP(addr[1:]).String(), true
+	case lanHostIPv6:
+		if len(addr) != 1+net.IPv6len {
+			return "", false
+		}
+
+		return net.IP(addr[1:]).String(), true
+	case lanHostName:
+		if len(addr) < 2 || len(addr) != 2+int(addr[1]) || addr[1] == 0 {
+			return "", false
+		}
+
+		return string(addr[2:]), true
+	}
+
+	return "", false
+}
+
+// createRequest host is on LAN, empty means local
+func (l *link) createRequest(idx uint16, tag uint16, host string, port uint16, dgram bool) {
+	req := newRequest(l, idx, tag, dgram)
+
+	l.reqMutex.Lock()
+	old := l.requests[idx]
+	l.requests[idx] = req
+	l.reqMutex.Unlock()
+
+	if old != nil {
+		old.close(false)
+	}
+
+	if host != "" && !l.a.hostAllowed(host) {
+		log.Printf("agent host %s not allowed, idx:%d", host, idx)
+		req.close(true)
+		return
+	}
+
+	if host == "" && !l.a.portAllowed(port) {
+		log.Printf("agent port %d not allowed, idx:%d", port, idx)
+		req.close(true)
+		return
+	}
+
+	go req.serve(host, port)
+}
+
+func (l *link) getRequest(idx uint16, tag uint16) *request {
+	l.reqMutex.Lock()
+	defer l.reqMutex.Unlock()
+
+	req := l.requests[idx]
+	if req == nil || req.tag != tag {
+		return nil
+	}
+
+	return req
+}
+
+func (l *link) removeRequest(req *request) {
+	l.reqMutex.Lock()
+	if l.requests[req.idx] == req {
+		delete(l.requests, req.idx)
+	}
+	l.reqMutex.Unlock()
+}
+
+func (l *link) closeAll() {
+	l.reqMutex.Lock()
+	list := make([]*request, 0, len(l.requests))
+	for _, r := range l.requests {
+		list = append(list, r)
+	}
+	l.reqMutex.Unlock()
+
+	for _, r := range list {
+		r.close(false)
+	}
+}
+
+func (l *link) count() int {
+	l.reqMutex.Lock()
+	defer l.reqMutex.Unlock()
+
+	return len(l.requests)
+}
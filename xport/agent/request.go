@@ -0,0 +1,268 @@
+package agent
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// read buffer of local conn, old server limits frame to 8k,
+	// larger is allowed if lws extended length negotiated
+	readBufferSize    = 8*1024 - 5
+	extReadBufferSize = 64 * 1024
+	// drop datagrams when so many waiting to write
+	maxDgramQueue = 64
+	// bytes of stream may be sent beyond the written count server reported,
+	// since protocolVersion 5
+	serverWindow = 256 * 1024
+)
+
+// request a request from server, bridged to local port
+type request struct {
+	l     *link
+	idx   uint16
+	tag   uint16
+	dgram bool
+
+	cond     *sync.Cond
+	pending  [][]byte
+	finished bool
+	closed   bool
+	conn     net.Conn
+
+	// server holds back stream by window, sent and written count in bytes
+	windowed bool
+	sent     uint32
+	written  uint32
+}
+
+func newRequest(l *link, idx uint16, tag uint16, dgram bool) *request {
+	return &request{
+		l:        l,
+		idx:      idx,
+		tag:      tag,
+		dgram:    dgram,
+		cond:     sync.NewCond(&sync.Mutex{}),
+		windowed: l.version >= 5 && !dgram,
+	}
+}
+
+func (r *request) header(cmd byte, size int) []byte {
+	msg := make([]byte, 5+size)
+	msg[0] = cmd
+	binary.LittleEndian.PutUint16(msg[1:], r.idx)
+	binary.LittleEndian.PutUint16(msg[3:], r.tag)
+
+	return msg
+}
+
+// push queue data from server, nil means client finished
+func (r *request) push(data []byte) {
+	r.cond.L.Lock()
+	defer r.cond.L.Unlock()
+
+	if r.closed || r.finished {
+		return
+	}
+
+	if data == nil {
+		r.finished = true
+	} else if r.dgram && len(r.pending) >= maxDgramQueue {
+		log.Printf("agent request %d queue full, drop datagram", r.idx)
+		return
+	} else {
+		r.pending = append(r.pending, data)
+	}
+
+	r.cond.Broadcast()
+}
+
+// close close local conn, tell server if notify
+func (r *request) close(notify bool) {
+	r.cond.L.Lock()
+	if r.closed {
+		r.cond.L.Unlock()
+		return
+	}
+
+	r.closed = true
+	conn := r.conn
+	r.cond.Broadcast()
+	r.cond.L.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+
+	r.l.removeRequest(r)
+	if notify {
+		r.l.send(r.header(cmdReqServerClosed, 0))
+	}
+}
+
+// serve dial host, or local port if host is empty
+func (r *request) serve(host string, port uint16) {
+	network := "tcp"
+	if r.dgram {
+		network = "udp"
+	}
+
+	if host == "" {
+		host = "127.0.0.1"
+	}
+
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	conn, err := net.DialTimeout(network, addr, 10*time.Second)
+	if err != nil {
+		log.Printf("agent request %d dial %s failed:%v", r.idx, addr, err)
+		r.close(true)
+		return
+	}
+
+	r.cond.L.Lock()
+	if r.closed {
+		r.cond.L.Unlock()
+		conn.Close()
+		return
+	}
+
+	r.conn = conn
+	r.cond.L.Unlock()
+
+	log.Printf("agent request %d connected to %s %s", r.idx, network, addr)
+	go r.writeLoop(conn)
+	r.readLoop(conn)
+}
+
+// readLoop local to server
+func (r *request) readLoop(conn net.Conn) {
+	cmd := byte(cmdReqData)
+	if r.dgram {
+		cmd = cmdReqDgram
+	}
+
+	size := readBufferSize
+	if r.l.c.Extended() {
+		size = extReadBufferSize
+	}
+
+	buf := make([]byte, size)
+	for {
+		room := r.waitWindow(size)
+		if room == 0 {
+			return
+		}
+
+		n, err := conn.Read(buf[:room])
+		if n > 0 {
+			msg := r.header(cmd, n)
+			copy(msg[5:], buf[:n])
+			r.onSent(n)
+			r.l.send(msg)
+		}
+
+		if err == io.EOF && !r.dgram {
+			r.l.send(r.header(cmdReqServerFinished, 0))
+			return
+		}
+
+		if err != nil {
+			r.close(true)
+			return
+		}
+	}
+}
+
+// waitWindow block until server allows sending, return at most max bytes
+// allowed, 0 if closed
+func (r *request) waitWindow(max int) int {
+	if !r.windowed {
+		return max
+	}
+
+	r.cond.L.Lock()
+	defer r.cond.L.Unlock()
+
+	for r.sent-r.written >= serverWindow && !r.closed {
+		r.cond.Wait()
+	}
+
+	if r.closed {
+		return 0
+	}
+
+	room := int(serverWindow - (r.sent - r.written))
+	if room > max {
+		room = max
+	}
+
+	return room
+}
+
+func (r *request) onSent(n int) {
+	if !r.windowed {
+		return
+	}
+
+	r.cond.L.Lock()
+	r.sent = r.sent + uint32(n)
+	r.cond.L.Unlock()
+}
+
+// onServerQuota server has written so many bytes, the count is absolute
+func (r *request) onServerQuota(written uint32) {
+	r.cond.L.Lock()
+	defer r.cond.L.Unlock()
+
+	if int32(written-r.written) > 0 {
+		r.written = written
+		r.cond.Broadcast()
+	}
+}
+
+// writeLoop server to local, grant quota after written
+func (r *request) writeLoop(conn net.Conn) {
+	quota := r.l.a.cfg.Quota > 0 && !r.dgram
+	for {
+		r.cond.L.Lock()
+		for len(r.pending) == 0 && !r.finished && !r.closed {
+			r.cond.Wait()
+		}
+
+		if r.closed {
+			r.cond.L.Unlock()
+			return
+		}
+
+		if len(r.pending) == 0 {
+			// client finished and all written
+			r.cond.L.Unlock()
+			if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
+			}
+			return
+		}
+
+		data := r.pending[0]
+		r.pending = r.pending[1:]
+		r.cond.L.Unlock()
+
+		_, err := conn.Write(data)
+		if err != nil {
+			r.close(true)
+			return
+		}
+
+		if quota {
+			msg := r.header(cmdReqClientQuota, 4)
+			binary.LittleEndian.PutUint32(msg[5:], uint32(len(data)))
+			r.l.send(msg)
+		}
+	}
+}
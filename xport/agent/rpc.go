@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	rpcCodecJSON = 0
+
+	rpcStatusOK       = 0
+	rpcStatusError    = 1
+	rpcStatusNoMethod = 2
+)
+
+// RPCHandler serve a method called by server, args is JSON unless codec is protobuf,
+// reply is encoded as JSON
+type RPCHandler func(codec byte, args []byte) (interface{}, error)
+
+// Status reply of built-in "status" method
+type Status struct {
+	UUID     string `json:"uuid"`
+	Version  string `json:"version"`
+	Arch     string `json:"arch"`
+	Uptime   int64  `json:"uptime"`
+	Requests int    `json:"requests"`
+}
+
+// HandleRPC register handler for method, replace the old one
+func (a *Agent) HandleRPC(method string, handler RPCHandler) {
+	a.rpcMutex.Lock()
+	a.rpcHandlers[method] = handler
+	a.rpcMutex.Unlock()
+}
+
+func (a *Agent) statusRPC(codec byte, args []byte) (interface{}, error) {
+	requests := 0
+	a.linkMutex.Lock()
+	if a.link != nil {
+		requests = a.link.count()
+	}
+	a.linkMutex.Unlock()
+
+	return &Status{
+		UUID:     a.cfg.UUID,
+		Version:  a.cfg.Version,
+		Arch:     a.cfg.Arch,
+		Uptime:   int64(time.Since(a.startedAt).Seconds()),
+		Requests: requests,
+	}, nil
+}
+
+func (a *Agent) onRPCRequest(l *link, message []byte) {
+	if len(message) < 7 || len(message) < 7+int(message[6]) {
+		log.Errorln("agent rpc request message too short")
+		return
+	}
+
+	id := binary.LittleEndian.Uint32(message[1:])
+	codec := message[5]
+	method := string(message[7 : 7+int(message[6])])
+	args := message[7+int(message[6]):]
+
+	a.rpcMutex.Lock()
+	handler := a.rpcHandlers[method]
+	a.rpcMutex.Unlock()
+
+	status := byte(rpcStatusOK)
+	var payload []byte
+	if handler == nil {
+		status = rpcStatusNoMethod
+		payload = []byte("no such method")
+	} else {
+		reply, err := handler(codec, args)
+		if err == nil {
+			payload, err = json.Marshal(reply)
+		}
+
+		if err != nil {
+			status = rpcStatusError
+			payload = []byte(err.Error())
+		}
+	}
+
+	msg := make([]byte, 7+len(payload))
+	msg[0] = cmdRPCResponse
+	binary.LittleEndian.PutUint32(msg[1:], id)
+	msg[5] = status
+	msg[6] = rpcCodecJSON
+	copy(msg[7:], payload)
+
+	l.send(msg)
+}
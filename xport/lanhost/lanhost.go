@@ -0,0 +1,39 @@
+// Package lanhost matches targets on device's LAN, it is shared by server
+// policies and the device agent
+package lanhost
+
+import (
+	"net"
+	"strings"
+)
+
+// Match match host against patterns, a pattern is an ip, a cidr,
+// a hostname, "*.suffix" or "*" for any host
+func Match(patterns []string, host string) bool {
+	ip := net.ParseIP(host)
+	for _, pattern := range patterns {
+		switch {
+		case pattern == "*":
+			return true
+		case strings.Contains(pattern, "/"):
+			_, ipnet, err := net.ParseCIDR(pattern)
+			if err == nil && ip != nil && ipnet.Contains(ip) {
+				return true
+			}
+		case net.ParseIP(pattern) != nil:
+			if ip != nil && ip.Equal(net.ParseIP(pattern)) {
+				return true
+			}
+		case strings.HasPrefix(pattern, "*."):
+			if ip == nil && strings.HasSuffix(strings.ToLower(host), strings.ToLower(pattern[1:])) {
+				return true
+			}
+		default:
+			if ip == nil && strings.EqualFold(strings.TrimSuffix(host, "."), pattern) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,37 @@
+package lanhost
+
+import (
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	patterns := []string{"192.168.1.0/24", "10.0.0.1", "fd00::/8", "*.lan", "nas"}
+	cases := []struct {
+		host string
+		want bool
+	}{
+		{"192.168.1.20", true},
+		{"192.168.2.20", false},
+		{"10.0.0.1", true},
+		{"10.0.0.2", false},
+		{"fd00::1", true},
+		{"printer.LAN", true},
+		{"lan", false},
+		{"NAS.", true},
+		{"nas.lan.example.com", false},
+	}
+
+	for _, c := range cases {
+		if got := Match(patterns, c.host); got != c.want {
+			t.Errorf("Match(%s) = %v, want %v", c.host, got, c.want)
+		}
+	}
+
+	if Match(nil, "192.168.1.20") {
+		t.Error("empty patterns should match nothing")
+	}
+
+	if !Match([]string{"*"}, "anything") {
+		t.Error("* should match any host")
+	}
+}
@@ -0,0 +1,182 @@
+package lws
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Dialer lws client dialer
+type Dialer struct {
+	// NetDial dial the underlying connection, net.Dialer is used if nil
+	NetDial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// TLSClientConfig used by wss and https url
+	TLSClientConfig *tls.Config
+
+	// HandshakeTimeout zero means no timeout
+	HandshakeTimeout time.Duration
+
+	// ExtendedLength ask server for extended length mode, conn falls back to
+	// 2 bytes length if server does not accept it
+	ExtendedLength bool
+
+	// MaxMessageSize max message length in extended length mode,
+	// 0 means DefaultMaxMessageSize
+	MaxMessageSize int
+}
+
+// DefaultDialer dialer with 10 seconds handshake timeout
+var DefaultDialer = &Dialer{HandshakeTimeout: 10 * time.Second}
+
+// Dial connect to lws server by DefaultDialer, url scheme is one of ws, wss, http, https
+func Dial(urlStr string, header http.Header) (*Conn, *http.Response, error) {
+	return DefaultDialer.DialContext(context.Background(), urlStr, header)
+}
+
+// DialContext connect to lws server, do the websocket-like handshake,
+// response is returned when handshake failed for caller to inspect
+func (d *Dialer) DialContext(ctx context.Context, urlStr string, header http.Header) (*Conn, *http.Response, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tlsOn := false
+	switch u.Scheme {
+	case "ws", "http":
+	case "wss", "https":
+		tlsOn = true
+	default:
+		return nil, nil, fmt.Errorf("lws: bad scheme:%s", u.Scheme)
+	}
+
+	hostPort := u.Host
+	if u.Port() == "" {
+		if tlsOn {
+			hostPort = hostPort + ":443"
+		} else {
+			hostPort = hostPort + ":80"
+		}
+	}
+
+	if d.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.HandshakeTimeout)
+		defer cancel()
+	}
+
+	netDial := d.NetDial
+	if netDial == nil {
+		nd := &net.Dialer{}
+		netDial = nd.DialContext
+	}
+
+	nc, err := netDial(ctx, "tcp", hostPort)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+	}
+
+	if tlsOn {
+		cfg := &tls.Config{}
+		if d.TLSClientConfig != nil {
+			cfg = d.TLSClientConfig.Clone()
+		}
+
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+
+		tc := tls.Client(nc, cfg)
+		err = tc.Handshake()
+		if err != nil {
+			nc.Close()
+			return nil, nil, err
+		}
+
+		nc = tc
+	}
+
+	c, rsp, err := d.handshake(nc, u, header)
+	if err != nil {
+		nc.Close()
+		return nil, rsp, err
+	}
+
+	nc.SetDeadline(time.Time{})
+	return c, rsp, nil
+}
+
+func (d *Dialer) handshake(nc net.Conn, u *url.URL, header http.Header) (*Conn, *http.Response, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	challengeKey := base64.StdEncoding.EncodeToString(b)
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	// Upgrader matches the tokens case-sensitively
+	req.Header.Set("Connection", "upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", challengeKey)
+	if d.ExtendedLength {
+		req.Header.Set(ExtendedLengthHeader, "1")
+	}
+
+	err = req.Write(nc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(nc)
+	rsp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if rsp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, rsp, fmt.Errorf("lws: bad handshake, status:%d", rsp.StatusCode)
+	}
+
+	if rsp.Header.Get("Sec-Websocket-Accept") != computeAcceptKey(challengeKey) {
+		return nil, rsp, fmt.Errorf("lws: bad handshake, invalid accept key")
+	}
+
+	c := newConn(nc)
+	if d.ExtendedLength && rsp.Header.Get(ExtendedLengthHeader) == "1" {
+		c.setExtended(d.MaxMessageSize)
+	}
+
+	if br.Buffered() > 0 {
+		// server may send message right after handshake
+		c.r = br
+	}
+
+	return c, rsp, nil
+}
@@ -0,0 +1,79 @@
+package lws
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// Pipe in-memory connected lws conns, for tests
+func Pipe() (*Conn, *Conn) {
+	c1, c2 := net.Pipe()
+	return newConn(c1), newConn(c2)
+}
+
+var errPipeListenerClosed = errors.New("lws: pipe listener closed")
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// PipeListener in-memory net.Listener, conns are made by its Dial, it can be
+// used as Listener of httptest.Server to serve http and lws without network
+type PipeListener struct {
+	ch        chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// ListenPipe create a PipeListener
+func ListenPipe() *PipeListener {
+	return &PipeListener{
+		ch:   make(chan net.Conn),
+		done: make(chan struct{}),
+	}
+}
+
+// Accept wait for the next conn made by Dial
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.ch:
+		return c, nil
+	case <-l.done:
+		return nil, errPipeListenerClosed
+	}
+}
+
+// Close stop accepting, conns accepted are not closed
+func (l *PipeListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+
+	return nil
+}
+
+// Addr listener address
+func (l *PipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// Dial connect to the listener, network and addr are ignored,
+// it fits Dialer.NetDial and http.Transport.DialContext
+func (l *PipeListener) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	select {
+	case l.ch <- c2:
+		return c1, nil
+	case <-l.done:
+		c1.Close()
+		c2.Close()
+		return nil, errPipeListenerClosed
+	case <-ctx.Done():
+		c1.Close()
+		c2.Close()
+		return nil, ctx.Err()
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"crypto/sha1"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
@@ -13,8 +14,23 @@ import (
 	"time"
 )
 
+const (
+	// ExtendedLengthHeader peer sends it with value "1" in handshake to ask for
+	// extended length mode, and the server echoes it if accepted
+	ExtendedLengthHeader = "Lws-Extended-Length"
+
+	// DefaultMaxMessageSize max message length in extended length mode
+	DefaultMaxMessageSize = 1024 * 1024
+
+	// maxClassicLength max message length of 2 bytes header
+	maxClassicLength = 0xffff - 2
+)
+
 // Upgrader lws upgrader
 type Upgrader struct {
+	// MaxMessageSize max message length in extended length mode,
+	// 0 means DefaultMaxMessageSize
+	MaxMessageSize int
 }
 
 // tokenListContainsValue returns true if the 1#token header with the given
@@ -38,8 +54,9 @@ func computeAcceptKey(challengeKey string) string {
 	return base64.StdEncoding.EncodeToString(h.Sum(nil))
 }
 
-// Upgrade upgrade http request to lws conn
-func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+// Upgrade upgrade http request to lws conn, responseHeader is included in
+// the response to client's upgrade request, may be nil
+func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (*Conn, error) {
 	if !tokenListContainsValue(r.Header, "Connection", "upgrade") {
 		return nil, fmt.Errorf("'upgrade' token not found in 'Connection' header")
 	}
@@ -73,6 +90,7 @@ func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error
 	}
 
 	c := newConn(netConn)
+	extended := r.Header.Get(ExtendedLengthHeader) == "1"
 
 	challengeKey := r.Header.Get("Sec-Websocket-Key")
 	if challengeKey == "" {
@@ -84,6 +102,15 @@ func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error
 	p = append(p, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: "...)
 	p = append(p, computeAcceptKey(challengeKey)...)
 	p = append(p, "\r\n"...)
+	if extended {
+		p = append(p, ExtendedLengthHeader+": 1\r\n"...)
+		c.setExtended(u.MaxMessageSize)
+	}
+	for k, vs := range responseHeader {
+		for _, v := range vs {
+			p = append(p, k+": "+v+"\r\n"...)
+		}
+	}
 	p = append(p, "\r\n"...)
 
 	// Clear deadlines set by HTTP server.
@@ -97,14 +124,39 @@ func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error
 	return c, nil
 }
 
-// Conn lws connection
+// Conn lws connection, message is prefixed by 2 bytes little endian length
+// that includes the header itself; in extended length mode, length 0 means
+// 4 bytes little endian content length follows
 type Conn struct {
 	nc         net.Conn
+	r          io.Reader
 	writeMutex sync.Mutex
+
+	extended   bool
+	maxMessage int
 }
 
 func newConn(nc net.Conn) *Conn {
-	return &Conn{nc: nc}
+	return &Conn{nc: nc, r: nc, maxMessage: maxClassicLength}
+}
+
+func (c *Conn) setExtended(max int) {
+	if max <= 0 {
+		max = DefaultMaxMessageSize
+	}
+
+	c.extended = true
+	c.maxMessage = max
+}
+
+// Extended whether extended length mode is negotiated
+func (c *Conn) Extended() bool {
+	return c.extended
+}
+
+// MaxMessageLength max content length that can be read or written
+func (c *Conn) MaxMessageLength() int {
+	return c.maxMessage
 }
 
 // Close close lws connection
@@ -116,20 +168,24 @@ func (c *Conn) Close() error {
 func (c *Conn) ReadMessage() ([]byte, error) {
 	// read 2 bytes header
 	lenBuf := []byte{0, 0}
-	_, err := io.ReadFull(c.nc, lenBuf)
+	_, err := io.ReadFull(c.r, lenBuf)
 	if err != nil {
 		return nil, err
 	}
 
 	var len uint16 = uint16(lenBuf[1])
 	len = (len << 8) | uint16(lenBuf[0])
+	if len == 0 && c.extended {
+		return c.readExtended()
+	}
+
 	if len <= 2 {
 		return nil, fmt.Errorf("lws invalid length")
 	}
 
 	len = len - 2
 	content := make([]byte, len)
-	_, err = io.ReadFull(c.nc, content)
+	_, err = io.ReadFull(c.r, content)
 	if err != nil {
 		return nil, err
 	}
@@ -138,11 +194,47 @@ func (c *Conn) ReadMessage() ([]byte, error) {
 	return content, nil
 }
 
+func (c *Conn) readExtended() ([]byte, error) {
+	lenBuf := make([]byte, 4)
+	_, err := io.ReadFull(c.r, lenBuf)
+	if err != nil {
+		return nil, err
+	}
+
+	len := binary.LittleEndian.Uint32(lenBuf)
+	if len == 0 || len > uint32(c.maxMessage) {
+		return nil, fmt.Errorf("lws invalid extended length:%d", len)
+	}
+
+	content := make([]byte, len)
+	_, err = io.ReadFull(c.r, content)
+	if err != nil {
+		return nil, err
+	}
+
+	return content, nil
+}
+
 // WriteMessage write message to lws connection
 func (c *Conn) WriteMessage(content []byte) error {
+	if len(content) > c.maxMessage {
+		return fmt.Errorf("lws message too large:%d", len(content))
+	}
+
 	c.writeMutex.Lock()
 	defer c.writeMutex.Unlock()
 
+	if len(content) > maxClassicLength {
+		lenBuf := make([]byte, 6)
+		binary.LittleEndian.PutUint32(lenBuf[2:], uint32(len(content)))
+		err := writeAll(lenBuf, c.nc)
+		if err != nil {
+			return err
+		}
+
+		return writeAll(content, c.nc)
+	}
+
 	// write 2 bytes header
 	len := uint16(len(content) + 2)
 	lenBuf := []byte{0, 0}
@@ -157,6 +249,12 @@ func (c *Conn) WriteMessage(content []byte) error {
 	return writeAll(content, c.nc)
 }
 
+// SetReadDeadline sets the read deadline on the underlying network connection,
+// a zero value for t means ReadMessage will not time out
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.nc.SetReadDeadline(t)
+}
+
 // RemoteAddr returns the remote network address.
 func (c *Conn) RemoteAddr() net.Addr {
 	return c.nc.RemoteAddr()
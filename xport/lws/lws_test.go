@@ -0,0 +1,139 @@
+package lws
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDialEcho(t *testing.T) {
+	l := ListenPipe()
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := &Upgrader{}
+		c, err := u.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error("upgrade:", err)
+			return
+		}
+
+		defer c.Close()
+		for {
+			message, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			c.WriteMessage(message)
+		}
+	}))
+
+	ts.Listener.Close()
+	ts.Listener = l
+	ts.Start()
+	defer ts.Close()
+
+	d := &Dialer{NetDial: l.Dial}
+	c, _, err := d.DialContext(context.Background(), ts.URL+"/lws?tok=abc", nil)
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+
+	defer c.Close()
+
+	for _, n := range []int{1, 1024, 0xffff - 2} {
+		message := bytes.Repeat([]byte{byte(n)}, n)
+		err = c.WriteMessage(message)
+		if err != nil {
+			t.Fatal("write:", err)
+		}
+
+		echo, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal("read:", err)
+		}
+
+		if !bytes.Equal(echo, message) {
+			t.Fatalf("echo mismatch, len:%d, want:%d", len(echo), n)
+		}
+	}
+
+	err = c.WriteMessage(make([]byte, 0xffff))
+	if err == nil {
+		t.Fatal("oversize message should fail")
+	}
+}
+
+func TestDialBadHandshake(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	_, rsp, err := Dial(ts.URL, nil)
+	if err == nil {
+		t.Fatal("dial should fail")
+	}
+
+	if rsp == nil || rsp.StatusCode != http.StatusNotFound {
+		t.Fatal("response should be returned, got:", rsp)
+	}
+}
+
+func TestPipe(t *testing.T) {
+	c1, c2 := Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go c1.WriteMessage([]byte("ping"))
+	message, err := c2.ReadMessage()
+	if err != nil || string(message) != "ping" {
+		t.Fatal("pipe read:", string(message), err)
+	}
+}
+
+func TestDialExtendedLength(t *testing.T) {
+	l := ListenPipe()
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := &Upgrader{}
+		c, err := u.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error("upgrade:", err)
+			return
+		}
+
+		defer c.Close()
+		if !c.Extended() {
+			t.Error("server conn should be extended")
+		}
+
+		message, err := c.ReadMessage()
+		if err == nil {
+			c.WriteMessage(message)
+		}
+	}))
+
+	ts.Listener.Close()
+	ts.Listener = l
+	ts.Start()
+	defer ts.Close()
+
+	d := &Dialer{NetDial: l.Dial, ExtendedLength: true}
+	c, _, err := d.DialContext(context.Background(), ts.URL, nil)
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+
+	defer c.Close()
+
+	if !c.Extended() || c.MaxMessageLength() != DefaultMaxMessageSize {
+		t.Fatal("client conn should be extended")
+	}
+
+	message := bytes.Repeat([]byte{'x'}, 200*1024)
+	go c.WriteMessage(message)
+
+	echo, err := c.ReadMessage()
+	if err != nil || !bytes.Equal(echo, message) {
+		t.Fatal("extended echo failed:", len(echo), err)
+	}
+}
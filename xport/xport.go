@@ -4,6 +4,7 @@ import (
 	"lproxy/server"
 	"lproxy/servercfg"
 	"lproxy/xport/lws"
+	"net/http"
 	"strconv"
 
 	"github.com/gorilla/websocket"
@@ -14,7 +15,7 @@ var (
 	upgrader    = websocket.Upgrader{} // use default options
 	lwsupgrader = lws.Upgrader{}
 
-	devices = make(map[string]*XDevice)
+	devices = newDeviceRegistry()
 )
 
 const (
@@ -28,6 +29,36 @@ const (
 	cmdReqClientQuota    = 7
 	cmdPing              = 8
 	cmdPong              = 9
+	cmdReqDgramCreated   = 10
+	cmdReqDgram          = 11
+	cmdSessionInfo       = 12
+	cmdReqAck            = 13
+	// since xportVersionNotify
+	cmdNotify = 14
+	// since xportVersionRPC
+	cmdRPCRequest  = 15
+	cmdRPCResponse = 16
+	// create request to a host on device's LAN, since xportVersionLANHost
+	cmdReqHostCreated      = 17
+	cmdReqHostDgramCreated = 18
+	// server allows device to send more data of request, since xportVersionServerQuota
+	cmdReqServerQuota = 19
+)
+
+const (
+	// xportVersionHeader server replies the negotiated protocol version
+	// in lws handshake
+	xportVersionHeader = "Xport-Version"
+
+	// protocol versions, device provides the highest version it supports by
+	// 'ver' query, absent means xportVersionBase, the lower one of device
+	// and server is used, each version adds commands to the previous one
+	xportVersionBase        = 1
+	xportVersionNotify      = 2
+	xportVersionRPC         = 3
+	xportVersionLANHost     = 4
+	xportVersionServerQuota = 5
+	xportVersion            = xportVersionServerQuota
 )
 
 func xportServeLWS(ctx *server.RequestContext) {
@@ -45,7 +76,60 @@ func xportServeLWS(ctx *server.RequestContext) {
 		return
 	}
 
-	c, err := lwsupgrader.Upgrade(ctx.W, ctx.R)
+	if cap <= 0 {
+		ctx.Log.Println("invalid cap:", cap)
+		return
+	}
+
+	if cap > servercfg.XPortMaxSlots {
+		ctx.Log.Printf("cap %d exceed max slots, clamp it to:%d", cap, servercfg.XPortMaxSlots)
+		cap = servercfg.XPortMaxSlots
+	}
+
+	// quota is optional, device that support flow control provide
+	// the initial quota of each request, and grant more by cmdReqClientQuota
+	quota := 0
+	quotastr := query.Get("quota")
+	if quotastr != "" {
+		quota, err = strconv.Atoi(quotastr)
+		if err != nil {
+			ctx.Log.Println("convert quota error:", err)
+			return
+		}
+
+		if quota < 0 {
+			ctx.Log.Println("invalid quota:", quota)
+			return
+		}
+	}
+
+	// resume=1 means device support session resumption, it provides
+	// the session id when reconnecting
+	resumable := query.Get("resume") == "1" && servercfg.XPortResumeGrace > 0
+	session := query.Get("session")
+
+	version := xportVersionBase
+	verstr := query.Get("ver")
+	if verstr != "" {
+		version, err = strconv.Atoi(verstr)
+		if err != nil {
+			ctx.Log.Println("convert ver error:", err)
+			return
+		}
+
+		if version < xportVersionBase {
+			ctx.Log.Println("invalid ver:", version)
+			return
+		}
+
+		if version > xportVersion {
+			version = xportVersion
+		}
+	}
+
+	header := http.Header{}
+	header.Set(xportVersionHeader, strconv.Itoa(version))
+	c, err := lwsupgrader.Upgrade(ctx.W, ctx.R, header)
 	if err != nil {
 		ctx.Log.Println("upgrade:", err)
 		return
@@ -55,54 +139,95 @@ func xportServeLWS(ctx *server.RequestContext) {
 	ctx.Log.Println("accept lws from:", peerAddr)
 	defer c.Close()
 
-	// wait old xdevice to exit
-	old, ok := devices[uuid]
-	if ok {
-		old.close()
-		old.wg.Wait()
-		ctx.Log.Println("wait old xdevice exit ok:", uuid)
+	if resumable && session != "" {
+		old := devices.Get(uuid)
+		if old != nil && old.resume(session, c, version) {
+			ctx.Log.Println("resume lws session ok:", session)
+			old.wg.Add(1)
+			defer old.wg.Done()
+
+			old.loopMsg()
+			ctx.Log.Println("serv lws end:", peerAddr)
+			return
+		}
 	}
 
-	new := newXDevice(uuid, c, cap)
-	_, ok = devices[uuid]
-	if ok {
-		ctx.Log.Println("try to add device conflict")
-		return
+	new := newXDevice(uuid, c, cap, quota)
+	new.version = version
+	if resumable {
+		new.resumable = true
+		new.sessionID = newSessionID()
 	}
 
-	devices[uuid] = new
 	new.wg.Add(1)
-	defer func() {
-		delete(devices, uuid)
-		new.wg.Done()
-	}()
+	defer new.wg.Done()
+
+	// replace old xdevice atomically, then wait it to exit
+	old := devices.Replace(new)
+	if old != nil {
+		old.shutdown()
+		old.wg.Wait()
+		ctx.Log.Println("wait old xdevice exit ok:", uuid)
+	}
+
+	if resumable {
+		new.sendSessionInfo()
+	}
 
 	new.loopMsg()
 	ctx.Log.Println("serv lws end:", peerAddr)
 }
 
 func xportServeWebsocket(ctx *server.RequestContext) {
+	account, ok := authenticateClient(ctx)
+	if !ok {
+		replyError(ctx, http.StatusUnauthorized, "invalid client token")
+		return
+	}
+
 	devUUID := ctx.Query.Get("uuid")
 	if devUUID == "" {
-		log.Println("no dev uuid provided")
+		replyError(ctx, http.StatusBadRequest, "no dev uuid provided")
 		return
 	}
 
-	targetPortStr := ctx.Query.Get("port")
-	if targetPortStr == "" {
-		log.Println("no port provided")
+	// target port is resolved by 'service' name or 'port' number,
+	// 'host' means the target is on device's LAN rather than device itself
+	host := ctx.Query.Get("host")
+	targetPort, code, reason := resolveTarget(devUUID, host, ctx.Query.Get("service"),
+		ctx.Query.Get("port"))
+	if code != http.StatusOK {
+		replyError(ctx, code, reason)
 		return
 	}
 
-	targetPort, err := strconv.Atoi(targetPortStr)
-	if err != nil {
-		log.Println("convert port failed:", err)
+	// proto=udp means every websocket message is a datagram
+	dgram := false
+	proto := ctx.Query.Get("proto")
+	if proto == "udp" {
+		dgram = true
+	} else if proto != "" && proto != "tcp" {
+		replyError(ctx, http.StatusBadRequest, "unsupported proto")
 		return
 	}
 
-	xdev, ok := devices[devUUID]
-	if !ok {
-		log.Println("no dev found for uuid:", devUUID)
+	// halfclose=1 means an empty message is write-shutdown in both directions,
+	// otherwise empty messages are ignored, e.g. keepalive of some clients
+	halfClose := ctx.Query.Get("halfclose") == "1"
+
+	if !authorizeClient(account, devUUID, host, int(targetPort)) {
+		replyError(ctx, http.StatusForbidden, "not allowed to reach the device port")
+		return
+	}
+
+	xdev := devices.Get(devUUID)
+	if xdev == nil {
+		// device may be held by other node
+		if clusterServeWebsocket(ctx, devUUID) {
+			return
+		}
+
+		replyError(ctx, http.StatusNotFound, "no dev found for uuid")
 		return
 	}
 
@@ -112,16 +237,18 @@ func xportServeWebsocket(ctx *server.RequestContext) {
 		return
 	}
 
-	log.Println("accept websocket from:", c.RemoteAddr())
+	log.Printf("accept websocket from:%s, account:%s", c.RemoteAddr(), account)
 	defer c.Close()
 
-	xreq := xdev.mountRequest(devUUID, uint16(targetPort), c)
-	if xreq != nil {
-		xreq.loopMsg()
-	} else {
-		log.Println("failed to mount request into xdev")
+	xreq, err := xdev.mountRequest(devUUID, host, targetPort, newWSClient(c, halfClose), dgram)
+	if err != nil {
+		log.Println("failed to mount request into xdev:", err)
+		c.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error()))
 		return
 	}
+
+	xreq.loopMsg()
 }
 
 func init() {
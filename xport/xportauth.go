@@ -0,0 +1,84 @@
+package server
+
+import (
+	"lproxy/server"
+	"lproxy/servercfg"
+	"lproxy/xport/lanhost"
+	"net/http"
+	"strings"
+)
+
+// clientToken get xport client token from query 'ctok' or 'Authorization' header,
+// browser websocket can't set header, so query is preferred
+func clientToken(ctx *server.RequestContext) string {
+	tk := ctx.Query.Get("ctok")
+	if tk != "" {
+		return tk
+	}
+
+	auth := ctx.R.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	return ""
+}
+
+// authenticateClient verify client token, return account
+func authenticateClient(ctx *server.RequestContext) (string, bool) {
+	tk := clientToken(ctx)
+	if tk == "" {
+		return "", false
+	}
+
+	return server.VerifyClientTK(tk)
+}
+
+// authorizeClient check whether the account may reach port of device,
+// or port of host on device's LAN if host is not empty
+func authorizeClient(account string, uuid string, host string, port int) bool {
+	for _, c := range servercfg.XPortClients {
+		if c.Account != account {
+			continue
+		}
+
+		if !containsDevice(c.Devices, uuid) {
+			continue
+		}
+
+		if host != "" && !lanhost.Match(c.LANHosts, host) {
+			continue
+		}
+
+		if len(c.Ports) == 0 || containsPort(c.Ports, port) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsDevice(devices []string, uuid string) bool {
+	for _, d := range devices {
+		if d == "*" || d == uuid {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+
+	return false
+}
+
+func replyError(ctx *server.RequestContext, code int, msg string) {
+	ctx.Log.Println("xport reply error:", code, msg)
+	http.Error(ctx.W, msg, code)
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// xclient the client side of a XRequest, e.g. websocket or tcp connection
+type xclient interface {
+	// readMessage read next message, an empty message means that
+	// peer has shutdown its write side
+	readMessage() ([]byte, error)
+	writeMessage(data []byte) error
+	// closeWrite shutdown the write side
+	closeWrite() error
+	close() error
+	remoteAddr() net.Addr
+}
+
+// wsClient websocket client, with halfClose an empty binary message means
+// write-shutdown, otherwise empty messages are ignored and the websocket is
+// closed once device has finished
+type wsClient struct {
+	conn      *websocket.Conn
+	halfClose bool
+}
+
+func newWSClient(conn *websocket.Conn, halfClose bool) *wsClient {
+	return &wsClient{conn: conn, halfClose: halfClose}
+}
+
+func (c *wsClient) readMessage() ([]byte, error) {
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil || len(message) > 0 || c.halfClose {
+			return message, err
+		}
+	}
+}
+
+func (c *wsClient) writeMessage(data []byte) error {
+	return c.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (c *wsClient) closeWrite() error {
+	if !c.halfClose {
+		// client replies the close, then its read fails and request is closed
+		return c.conn.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	}
+
+	return c.conn.WriteMessage(websocket.BinaryMessage, []byte{})
+}
+
+func (c *wsClient) close() error {
+	return c.conn.Close()
+}
+
+func (c *wsClient) remoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// tcpClient raw stream client, such as tcp connection
+type tcpClient struct {
+	conn    net.Conn
+	buf     []byte
+	eof     bool
+	closeCh chan struct{}
+	once    sync.Once
+}
+
+func newTCPClient(conn net.Conn) *tcpClient {
+	return &tcpClient{
+		conn:    conn,
+		buf:     make([]byte, maxExtMessageLength),
+		closeCh: make(chan struct{}),
+	}
+}
+
+func (c *tcpClient) readMessage() ([]byte, error) {
+	if c.eof {
+		// nothing more to read after FIN, wait until closed
+		<-c.closeCh
+		return nil, io.EOF
+	}
+
+	n, err := c.conn.Read(c.buf)
+	if n > 0 {
+		return c.buf[:n], nil
+	}
+
+	if err == io.EOF {
+		c.eof = true
+		return []byte{}, nil
+	}
+
+	return nil, err
+}
+
+func (c *tcpClient) writeMessage(data []byte) error {
+	return writeAll(c.conn, data)
+}
+
+func (c *tcpClient) closeWrite() error {
+	if cw, ok := c.conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	// half-close not supported, keep it open until both sides finished
+	return nil
+}
+
+func (c *tcpClient) close() error {
+	c.once.Do(func() {
+		close(c.closeCh)
+	})
+
+	return c.conn.Close()
+}
+
+func (c *tcpClient) remoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func writeAll(conn net.Conn, buf []byte) error {
+	wrote := 0
+	l := len(buf)
+	for wrote < l {
+		n, err := conn.Write(buf[wrote:])
+		if err != nil {
+			return err
+		}
+
+		wrote = wrote + n
+	}
+
+	return nil
+}
+
+// pipeConn an end of in-memory stream pipe, unlike net.Pipe it supports
+// half-close, so peer can tell FIN from device, deadlines are not supported
+type pipeConn struct {
+	r      *io.PipeReader
+	w      *io.PipeWriter
+	remote net.Addr
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// newPipe the first end is for XRequest, its remote address is the client
+// which holds the second end
+func newPipe(remote net.Addr) (*pipeConn, *pipeConn) {
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	return &pipeConn{r: r1, w: w2, remote: remote},
+		&pipeConn{r: r2, w: w1, remote: pipeAddr("xport")}
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func (c *pipeConn) CloseWrite() error {
+	return c.w.Close()
+}
+
+func (c *pipeConn) Close() error {
+	c.r.Close()
+	return c.w.Close()
+}
+
+func (c *pipeConn) LocalAddr() net.Addr                { return pipeAddr("xport") }
+func (c *pipeConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *pipeConn) SetDeadline(t time.Time) error      { return nil }
+func (c *pipeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *pipeConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,329 @@
+package server
+
+import (
+	"lproxy/server"
+	"lproxy/servercfg"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	clusterDevKeyPrefix  = "lproxy:dev:"
+	clusterNodeKeyPrefix = "lproxy:node:"
+	clusterRevokedPrefix = "lproxy:revoked:"
+
+	// clusterForwardedHeader marks request forwarded by other node, to avoid loop
+	clusterForwardedHeader = "X-Lproxy-Forwarded"
+)
+
+var (
+	redisPool *redis.Pool
+
+	clusterEvents = make(chan *DeviceEvent, 1024)
+	// clusterDropped count of events dropped since queue is full
+	clusterDropped uint64
+
+	// delete device route only if it is still owned by this node
+	delIfOwnerScript = redis.NewScript(1,
+		`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`)
+
+	clusterDialer = websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+)
+
+func clusterEnabled() bool {
+	return redisPool != nil
+}
+
+func startCluster() {
+	redisPool = &redis.Pool{
+		MaxIdle:     8,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", servercfg.RedisServer,
+				redis.DialConnectTimeout(5*time.Second),
+				redis.DialReadTimeout(5*time.Second),
+				redis.DialWriteTimeout(5*time.Second))
+		},
+	}
+
+	devices.Subscribe(clusterOnDeviceEvent)
+
+	server.SetTKRevokeStore(clusterRevokeStore{})
+
+	log.Printf("cluster mode enabled, node:%s, url:%s", servercfg.ServerID,
+		servercfg.ClusterAdvertiseURL)
+	go clusterLoop()
+}
+
+// clusterOnDeviceEvent queue event for clusterLoop, it must not block device
+// registry, so event is dropped if queue is full. A dropped online route is
+// restored by the next refresh, a dropped offline route expires by ttl
+func clusterOnDeviceEvent(ev *DeviceEvent) {
+	select {
+	case clusterEvents <- ev:
+	default:
+		n := atomic.AddUint64(&clusterDropped, 1)
+		log.Printf("cluster events queue full, drop %s event for:%s, total dropped:%d",
+			ev.Type, ev.UUID, n)
+	}
+}
+
+func clusterLoop() {
+	ttl := time.Duration(servercfg.ClusterDeviceTTL) * time.Second
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+
+	clusterRefresh()
+	for {
+		select {
+		case ev := <-clusterEvents:
+			clusterPublish(ev)
+		case <-ticker.C:
+			clusterRefresh()
+		}
+	}
+}
+
+// clusterPublish publish device route change to redis
+func clusterPublish(ev *DeviceEvent) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	var err error
+	key := clusterDevKeyPrefix + ev.UUID
+	switch ev.Type {
+	case DeviceOnline:
+		_, err = conn.Do("SET", key, servercfg.ServerID, "EX", servercfg.ClusterDeviceTTL)
+	case DeviceOffline:
+		_, err = delIfOwnerScript.Do(conn, key, servercfg.ServerID)
+	}
+
+	if err != nil {
+		log.Printf("cluster publish %s event for %s failed:%v", ev.Type, ev.UUID, err)
+	}
+}
+
+// clusterRefresh refresh ttl of this node and all devices it holds
+func clusterRefresh() {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	ttl := servercfg.ClusterDeviceTTL
+	conn.Send("SET", clusterNodeKeyPrefix+servercfg.ServerID, servercfg.ClusterAdvertiseURL, "EX", ttl)
+	for _, d := range devices.List() {
+		conn.Send("SET", clusterDevKeyPrefix+d.uuid, servercfg.ServerID, "EX", ttl)
+	}
+
+	_, err := conn.Do("")
+	if err != nil {
+		log.Println("cluster refresh failed:", err)
+	}
+}
+
+// clusterRevokeStore share device token revocations by redis, so a kicked
+// device can't reconnect to other nodes
+type clusterRevokeStore struct{}
+
+func (clusterRevokeStore) Revoke(account string, t int, ttl int) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SET", clusterRevokedPrefix+account, t, "EX", ttl)
+	return err
+}
+
+func (clusterRevokeStore) Revoked(account string) (int, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	t, err := redis.Int(conn.Do("GET", clusterRevokedPrefix+account))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+
+	return t, err
+}
+
+// clusterLookup find the base url of node that holds device, empty if not found
+func clusterLookup(uuid string) (string, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	nodeID, err := redis.String(conn.Do("GET", clusterDevKeyPrefix+uuid))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if nodeID == servercfg.ServerID {
+		// stale route of this node
+		return "", nil
+	}
+
+	url, err := redis.String(conn.Do("GET", clusterNodeKeyPrefix+nodeID))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+
+	return url, err
+}
+
+// withScheme replace scheme of url, ws and http are interchangeable
+func withScheme(url string, websocket bool) string {
+	switch {
+	case strings.HasPrefix(url, "https://") && websocket:
+		return "wss://" + strings.TrimPrefix(url, "https://")
+	case strings.HasPrefix(url, "http://") && websocket:
+		return "ws://" + strings.TrimPrefix(url, "http://")
+	case strings.HasPrefix(url, "wss://") && !websocket:
+		return "https://" + strings.TrimPrefix(url, "wss://")
+	case strings.HasPrefix(url, "ws://") && !websocket:
+		return "http://" + strings.TrimPrefix(url, "ws://")
+	}
+
+	return url
+}
+
+// clusterServeWebsocket redirect or forward websocket client to the node that
+// holds the device, return false if device is not found in cluster
+func clusterServeWebsocket(ctx *server.RequestContext, uuid string) bool {
+	if !clusterEnabled() || ctx.R.Header.Get(clusterForwardedHeader) != "" {
+		return false
+	}
+
+	nodeURL, err := clusterLookup(uuid)
+	if err != nil {
+		ctx.Log.Println("cluster lookup failed:", err)
+		return false
+	}
+
+	if nodeURL == "" {
+		return false
+	}
+
+	target := strings.TrimSuffix(nodeURL, "/") + ctx.R.URL.RequestURI()
+	if servercfg.ClusterRedirect {
+		ctx.Log.Println("cluster redirect websocket to:", nodeURL)
+		http.Redirect(ctx.W, ctx.R, withScheme(target, false), http.StatusTemporaryRedirect)
+		return true
+	}
+
+	header := http.Header{}
+	header.Set(clusterForwardedHeader, servercfg.ServerID)
+	auth := ctx.R.Header.Get("Authorization")
+	if auth != "" {
+		header.Set("Authorization", auth)
+	}
+
+	upstream, resp, err := clusterDialer.Dial(withScheme(target, true), header)
+	if err != nil {
+		ctx.Log.Println("cluster forward dial failed:", err)
+		if resp != nil {
+			replyError(ctx, resp.StatusCode, "forward to owner node failed")
+		} else {
+			replyError(ctx, http.StatusBadGateway, "forward to owner node failed")
+		}
+
+		return true
+	}
+
+	defer upstream.Close()
+
+	c, err := upgrader.Upgrade(ctx.W, ctx.R, nil)
+	if err != nil {
+		ctx.Log.Println("upgrade:", err)
+		return true
+	}
+
+	defer c.Close()
+
+	ctx.Log.Printf("cluster forward websocket from:%s to:%s", c.RemoteAddr(), nodeURL)
+	go pumpWebsocket(upstream, c)
+	pumpWebsocket(c, upstream)
+
+	return true
+}
+
+// clusterServeHTTP redirect or proxy http request to the node that holds the device,
+// host and credentials are kept for that node to route and authenticate,
+// return false if device is not found in cluster
+func clusterServeHTTP(ctx *server.RequestContext, uuid string) bool {
+	if !clusterEnabled() || ctx.R.Header.Get(clusterForwardedHeader) != "" {
+		return false
+	}
+
+	nodeURL, err := clusterLookup(uuid)
+	if err != nil {
+		ctx.Log.Println("cluster lookup failed:", err)
+		return false
+	}
+
+	if nodeURL == "" {
+		return false
+	}
+
+	if servercfg.ClusterRedirect {
+		target := strings.TrimSuffix(withScheme(nodeURL, false), "/") + ctx.R.URL.RequestURI()
+		ctx.Log.Println("cluster redirect http to:", nodeURL)
+		http.Redirect(ctx.W, ctx.R, target, http.StatusTemporaryRedirect)
+		return true
+	}
+
+	u, err := url.Parse(withScheme(nodeURL, false))
+	if err != nil {
+		ctx.Log.Println("cluster node url invalid:", err)
+		replyError(ctx, http.StatusBadGateway, "forward to owner node failed")
+		return true
+	}
+
+	rp := httputil.NewSingleHostReverseProxy(u)
+	director := rp.Director
+	rp.Director = func(r *http.Request) {
+		director(r)
+		r.Header.Set(clusterForwardedHeader, servercfg.ServerID)
+	}
+
+	ctx.Log.Println("cluster forward http to:", nodeURL)
+	rp.ServeHTTP(ctx.W, ctx.R)
+
+	return true
+}
+
+// pumpWebsocket copy messages from src to dst, close both when done
+func pumpWebsocket(dst *websocket.Conn, src *websocket.Conn) {
+	defer func() {
+		dst.Close()
+		src.Close()
+	}()
+
+	for {
+		mt, message, err := src.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		err = dst.WriteMessage(mt, message)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func init() {
+	server.InvokeAfterCfgLoaded(func() {
+		if servercfg.ClusterAdvertiseURL != "" {
+			startCluster()
+		}
+	})
+}
@@ -0,0 +1,365 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"lproxy/server"
+	"lproxy/servercfg"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// fakeRedis in-memory redis speaks the commands cluster uses:
+// GET, SET, DEL, EVALSHA (always NOSCRIPT) and EVAL of delIfOwnerScript
+type fakeRedis struct {
+	ln    net.Listener
+	mutex sync.Mutex
+	keys  map[string]string
+}
+
+func startFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("fake redis listen:", err)
+	}
+
+	fr := &fakeRedis{ln: ln, keys: make(map[string]string)}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go fr.serve(c)
+		}
+	}()
+
+	return fr
+}
+
+func (fr *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+
+	br := bufio.NewReader(c)
+	for {
+		args, err := readRESP(br)
+		if err != nil {
+			return
+		}
+
+		io.WriteString(c, fr.do(args))
+	}
+}
+
+// readRESP read a command, which is an array of bulk strings
+func readRESP(br *bufio.Reader) ([]string, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || line[0] != '*' {
+		return nil, fmt.Errorf("unexpected command:%q", line)
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		line, err = br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		l, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		b := make([]byte, l+2)
+		_, err = io.ReadFull(br, b)
+		if err != nil {
+			return nil, err
+		}
+
+		args[i] = string(b[:l])
+	}
+
+	return args, nil
+}
+
+func (fr *fakeRedis) do(args []string) string {
+	fr.mutex.Lock()
+	defer fr.mutex.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		v, ok := fr.keys[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "SET":
+		fr.keys[args[1]] = args[2]
+		return "+OK\r\n"
+	case "DEL":
+		_, ok := fr.keys[args[1]]
+		delete(fr.keys, args[1])
+		if ok {
+			return ":1\r\n"
+		}
+
+		return ":0\r\n"
+	case "EVALSHA":
+		return "-NOSCRIPT No matching script\r\n"
+	case "EVAL":
+		// delIfOwnerScript, script numkeys key owner
+		if fr.keys[args[3]] == args[4] {
+			delete(fr.keys, args[3])
+			return ":1\r\n"
+		}
+
+		return ":0\r\n"
+	}
+
+	return "-ERR unknown command\r\n"
+}
+
+func (fr *fakeRedis) get(key string) string {
+	fr.mutex.Lock()
+	defer fr.mutex.Unlock()
+
+	return fr.keys[key]
+}
+
+func (fr *fakeRedis) set(key string, value string) {
+	fr.mutex.Lock()
+	fr.keys[key] = value
+	fr.mutex.Unlock()
+}
+
+// withCluster enable cluster of node "node-a" by fake redis, without clusterLoop
+func withCluster(t *testing.T) (*fakeRedis, func()) {
+	fr := startFakeRedis(t)
+	addr := fr.ln.Addr().String()
+	redisPool = &redis.Pool{
+		MaxIdle: 2,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		},
+	}
+
+	serverID := servercfg.ServerID
+	servercfg.ServerID = "node-a"
+	servercfg.ClusterDeviceTTL = 60
+
+	return fr, func() {
+		redisPool.Close()
+		redisPool = nil
+		fr.ln.Close()
+		servercfg.ServerID = serverID
+		servercfg.ClusterRedirect = false
+	}
+}
+
+func newTestContext(w http.ResponseWriter, r *http.Request) *server.RequestContext {
+	return &server.RequestContext{
+		Log:   log.WithField("test", "cluster"),
+		Query: r.URL.Query(),
+		R:     r,
+		W:     w,
+	}
+}
+
+func TestClusterLookup(t *testing.T) {
+	fr, done := withCluster(t)
+	defer done()
+
+	fr.set(clusterDevKeyPrefix+"dev-b", "node-b")
+	fr.set(clusterNodeKeyPrefix+"node-b", "http://node-b:8000")
+	fr.set(clusterDevKeyPrefix+"dev-c", "node-c")
+
+	cases := []struct {
+		uuid string
+		want string
+	}{
+		{"dev-b", "http://node-b:8000"},
+		// node gone, its routes are stale
+		{"dev-c", ""},
+		{"no-such-dev", ""},
+	}
+
+	for _, c := range cases {
+		got, err := clusterLookup(c.uuid)
+		if err != nil || got != c.want {
+			t.Errorf("clusterLookup(%s) = %s, %v, want %s", c.uuid, got, err, c.want)
+		}
+	}
+
+	// route of this node is published, and stale one is ignored by lookup
+	clusterPublish(&DeviceEvent{Type: DeviceOnline, UUID: "dev-a"})
+	if fr.get(clusterDevKeyPrefix+"dev-a") != "node-a" {
+		t.Fatal("online route should be published")
+	}
+
+	if got, _ := clusterLookup("dev-a"); got != "" {
+		t.Fatal("route of this node should not be looked up, got:", got)
+	}
+
+	// device moved to other node, offline of this node must not remove it
+	fr.set(clusterDevKeyPrefix+"dev-a", "node-b")
+	clusterPublish(&DeviceEvent{Type: DeviceOffline, UUID: "dev-a"})
+	if fr.get(clusterDevKeyPrefix+"dev-a") != "node-b" {
+		t.Fatal("offline should only remove route owned by this node")
+	}
+
+	fr.set(clusterDevKeyPrefix+"dev-a", "node-a")
+	clusterPublish(&DeviceEvent{Type: DeviceOffline, UUID: "dev-a"})
+	if fr.get(clusterDevKeyPrefix+"dev-a") != "" {
+		t.Fatal("offline should remove route of this node")
+	}
+}
+
+func TestClusterServeHTTP(t *testing.T) {
+	fr, done := withCluster(t)
+	defer done()
+
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s", r.Header.Get(clusterForwardedHeader), r.Host, r.URL.RequestURI())
+	}))
+	defer owner.Close()
+
+	fr.set(clusterDevKeyPrefix+"dev-b", "node-b")
+	fr.set(clusterNodeKeyPrefix+"node-b", owner.URL)
+
+	// forward, host is kept for owner to route
+	r := httptest.NewRequest("GET", "http://dev-b.dev.test/a?b=c", nil)
+	w := httptest.NewRecorder()
+	if !clusterServeHTTP(newTestContext(w, r), "dev-b") {
+		t.Fatal("request should be forwarded")
+	}
+
+	body, _ := ioutil.ReadAll(w.Result().Body)
+	if string(body) != "node-a dev-b.dev.test /a?b=c" {
+		t.Fatal("forwarded request:", string(body))
+	}
+
+	// forwarded request is not forwarded again
+	r = httptest.NewRequest("GET", "http://dev-b.dev.test/a", nil)
+	r.Header.Set(clusterForwardedHeader, "node-c")
+	if clusterServeHTTP(newTestContext(httptest.NewRecorder(), r), "dev-b") {
+		t.Fatal("forwarded request should not be forwarded again")
+	}
+
+	if clusterServeHTTP(newTestContext(httptest.NewRecorder(), r), "no-such-dev") {
+		t.Fatal("device not in cluster should not be forwarded")
+	}
+
+	servercfg.ClusterRedirect = true
+	r = httptest.NewRequest("GET", "http://lproxy/dev/dev-b/80/a?b=c", nil)
+	w = httptest.NewRecorder()
+	if !clusterServeHTTP(newTestContext(w, r), "dev-b") {
+		t.Fatal("request should be redirected")
+	}
+
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != owner.URL+"/dev/dev-b/80/a?b=c" {
+		t.Fatal("redirect:", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestClusterServeWebsocket(t *testing.T) {
+	fr, done := withCluster(t)
+	defer done()
+
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(clusterForwardedHeader) != "node-a" || r.Header.Get("Authorization") != "Bearer ctok" {
+			http.Error(w, "not forwarded", http.StatusForbidden)
+			return
+		}
+
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		defer c.Close()
+		for {
+			mt, message, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			c.WriteMessage(mt, append([]byte(r.URL.RawQuery+" "), message...))
+		}
+	}))
+	defer owner.Close()
+
+	fr.set(clusterDevKeyPrefix+"dev-b", "node-b")
+	fr.set(clusterNodeKeyPrefix+"node-b", owner.URL)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !clusterServeWebsocket(newTestContext(w, r), r.URL.Query().Get("uuid")) {
+			http.Error(w, "no dev", http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer ctok")
+	u := "ws" + strings.TrimPrefix(ts.URL, "http") + "/xport?uuid=dev-b"
+	c, _, err := websocket.DefaultDialer.Dial(u, header)
+	if err != nil {
+		t.Fatal("websocket should be forwarded:", err)
+	}
+
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	c.WriteMessage(websocket.BinaryMessage, []byte("hello"))
+	_, message, err := c.ReadMessage()
+	if err != nil || string(message) != "uuid=dev-b hello" {
+		t.Fatal("forwarded websocket echo:", string(message), err)
+	}
+
+	servercfg.ClusterRedirect = true
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	rsp, err := client.Get(ts.URL + "/xport?uuid=dev-b")
+	if err != nil {
+		t.Fatal("redirect websocket:", err)
+	}
+
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusTemporaryRedirect || rsp.Header.Get("Location") != owner.URL+"/xport?uuid=dev-b" {
+		t.Fatal("websocket redirect:", rsp.StatusCode, rsp.Header.Get("Location"))
+	}
+}
+
+func TestClusterEventsDropped(t *testing.T) {
+	// queue is not consumed without clusterLoop
+	defer func() {
+		for len(clusterEvents) > 0 {
+			<-clusterEvents
+		}
+	}()
+
+	dropped := atomic.LoadUint64(&clusterDropped)
+	for i := 0; i < cap(clusterEvents)+2; i++ {
+		clusterOnDeviceEvent(&DeviceEvent{Type: DeviceOnline, UUID: "dev-drop"})
+	}
+
+	if n := atomic.LoadUint64(&clusterDropped) - dropped; n != 2 {
+		t.Fatal("events beyond queue should be dropped and counted, got:", n)
+	}
+}
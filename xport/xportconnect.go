@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"lproxy/server"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// http connect, client token is provided by 'Proxy-Authorization' header,
+// either Basic with token as password, or Bearer
+
+const (
+	connectEstablished = "HTTP/1.1 200 Connection established\r\n\r\n"
+)
+
+func serveConnectConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(proxyHandshakeTimeout))
+	br := bufio.NewReader(conn)
+	r, err := http.ReadRequest(br)
+	if err != nil {
+		log.Printf("http connect read request from %s failed:%v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	t, code, reason := connectHandshake(r)
+	if code != http.StatusOK {
+		log.Printf("http connect from %s to %s failed:%s", conn.RemoteAddr(), r.Host, reason)
+		connectReply(conn, code, reason)
+		conn.Close()
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	// client may send data right after the request
+	c := net.Conn(conn)
+	if br.Buffered() > 0 {
+		c = &bufferedConn{Conn: conn, r: br}
+	}
+
+	// success is replied through request, so data from device can't go ahead of it
+	xreq, err := t.mount(c, []byte(connectEstablished))
+	if err != nil {
+		log.Println("failed to mount request into xdev:", err)
+		connectReply(conn, http.StatusBadGateway, err.Error())
+		conn.Close()
+		return
+	}
+
+	log.Printf("http connect accept from:%s, account:%s, uuid:%s, host:%s, port:%d",
+		conn.RemoteAddr(), t.account, t.uuid, t.host, t.port)
+
+	xreq.loopMsg()
+}
+
+// connectHandshake authenticate and resolve destination,
+// return http status code with reason if failed
+func connectHandshake(r *http.Request) (*proxyTarget, int, string) {
+	if r.Method != "CONNECT" {
+		return nil, http.StatusMethodNotAllowed, "only CONNECT is supported"
+	}
+
+	user, token := connectCredentials(r)
+	account, ok := "", false
+	if token != "" {
+		account, ok = server.VerifyClientTK(token)
+	}
+
+	if !ok {
+		return nil, http.StatusProxyAuthRequired, "invalid client token"
+	}
+
+	host, portStr, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		return nil, http.StatusBadRequest, "invalid destination"
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, http.StatusBadRequest, "invalid destination port"
+	}
+
+	return resolveProxyTarget(account, user, host, port)
+}
+
+// connectCredentials user and token from 'Proxy-Authorization' header
+func connectCredentials(r *http.Request) (string, string) {
+	auth := r.Header.Get("Proxy-Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return "", strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	// parse it as Authorization
+	ar := &http.Request{Header: http.Header{"Authorization": []string{auth}}}
+	user, password, ok := ar.BasicAuth()
+	if !ok {
+		return "", ""
+	}
+
+	return user, password
+}
+
+// connectReply reply failure, success is replied by connectEstablished
+func connectReply(conn net.Conn, code int, reason string) error {
+	rsp := fmt.Sprintf("HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	if code == http.StatusProxyAuthRequired {
+		rsp = rsp + "Proxy-Authenticate: Basic realm=\"xport\"\r\n"
+	}
+
+	rsp = rsp + fmt.Sprintf("Content-Length: %d\r\nConnection: close\r\n\r\n%s", len(reason), reason)
+	_, err := io.WriteString(conn, rsp)
+	return err
+}
+
+// bufferedConn conn with data already read into buffer
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return nil
+}
@@ -2,62 +2,311 @@ package server
 
 import (
 	"encoding/binary"
+	"fmt"
+	"lproxy/servercfg"
 	"lproxy/xport/lws"
 	"sync"
+	"time"
 
-	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 )
 
 // XDevice device
 type XDevice struct {
-	uuid     string
-	conn     *lws.Conn
-	requests []*XRequest
-	wg       sync.WaitGroup
-}
+	uuid      string
+	peerAddr  string
+	conn      *lws.Conn
+	connMutex sync.Mutex
+	wg        sync.WaitGroup
 
-func newXDevice(uuid string, conn *lws.Conn, cap int) *XDevice {
-	requests := make([]*XRequest, cap)
-	for i := 0; i < cap; i++ {
-		requests[i] = &XRequest{idx: uint16(i)}
-	}
+	// request slots, see xportslots.go
+	slotMutex sync.Mutex
+	requests  []*XRequest
+	freeSlots []uint16
+	cap       int
+
+	// session resumption, see xportsession.go
+	resumable  bool
+	sessionID  string
+	detached   bool
+	shut       bool
+	graceTimer *time.Timer
+	linkGen    int
+	// requests freed before device saw their close, told after resumed
+	pausedCloses []uint32
+
+	// initial quota for each request, 0 means device does not support flow control
+	quota int
+
+	// lws extended length mode, allows larger data frame
+	extended bool
+	// negotiated protocol version
+	version int
+
+	// keepalive
+	pingMutex   sync.Mutex
+	pingWaiting bool
+	pongTimer   *time.Timer
+	rtt         time.Duration
+
+	// traffic accounting
+	connectedAt      time.Time
+	traffic          trafficCounter
+	sessions         uint64
+	sessionsDuration int64
+
+	limiter *bandwidthLimiter
+
+	// frames to device, see xportsched.go
+	sched *writeScheduler
 
-	return &XDevice{
+	// rpc calls waiting for response, see xportrpc.go
+	rpcMutex  sync.Mutex
+	rpcSeq    uint32
+	rpcCalls  map[uint32]*rpcCall
+	rpcClosed bool
+}
+
+func newXDevice(uuid string, conn *lws.Conn, cap int, quota int) *XDevice {
+	d := &XDevice{
 		uuid:     uuid,
+		peerAddr: conn.RemoteAddr().String(),
 		conn:     conn,
-		requests: requests,
+		cap:      cap,
+		quota:    quota,
+		extended: conn.Extended(),
+		version:  xportVersionBase,
+
+		connectedAt: time.Now(),
+		limiter:     newBandwidthLimiter(GetDeviceBandwidth(uuid)),
 	}
+
+	d.sched = newWriteScheduler(d)
+	go d.sched.loop()
+
+	return d
 }
 
-func (d *XDevice) close() {
-	if d.conn != nil {
-		d.conn.Close()
+// UUID device uuid
+func (d *XDevice) UUID() string {
+	return d.uuid
+}
+
+// PeerAddr remote address of current lws link
+func (d *XDevice) PeerAddr() string {
+	d.connMutex.Lock()
+	defer d.connMutex.Unlock()
+
+	return d.peerAddr
+}
+
+// Resumable whether device session can be resumed after link broken
+func (d *XDevice) Resumable() bool {
+	return d.resumable
+}
+
+// Version negotiated protocol version
+func (d *XDevice) Version() int {
+	return d.version
+}
+
+// Detached whether device session is waiting for resume
+func (d *XDevice) Detached() bool {
+	d.connMutex.Lock()
+	defer d.connMutex.Unlock()
+
+	return d.detached
+}
+
+// Kick disconnect device, its session can't be resumed
+func (d *XDevice) Kick() {
+	log.Printf("XDevice kicked, uuid:%s", d.uuid)
+	d.shutdown()
+}
+
+// CloseRequest close an active request by its slot idx
+func (d *XDevice) CloseRequest(idx uint16) error {
+	r := d.slot(idx)
+	if r == nil {
+		return fmt.Errorf("no active request for idx:%d", idx)
 	}
 
+	tag, ok := r.currentTag()
+	if !ok {
+		return fmt.Errorf("no active request for idx:%d", idx)
+	}
+
+	log.Printf("xrequest closed by admin, uuid:%s, idx:%d, tag:%d", d.uuid, idx, tag)
+	r.closeTag(tag)
+	return nil
+}
+
+// RTT round trip time measured by the last server ping
+func (d *XDevice) RTT() time.Duration {
+	d.pingMutex.Lock()
+	defer d.pingMutex.Unlock()
+
+	return d.rtt
+}
+
+// keepalive ping device until the link closed
+func (d *XDevice) keepalive(linkCh chan struct{}) {
+	if servercfg.XPortPingInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(servercfg.XPortPingInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-linkCh:
+			d.pingMutex.Lock()
+			if d.pongTimer != nil {
+				d.pongTimer.Stop()
+				d.pongTimer = nil
+			}
+			d.pingWaiting = false
+			d.pingMutex.Unlock()
+			return
+		case <-ticker.C:
+			d.sendPing()
+		}
+	}
+}
+
+func (d *XDevice) sendPing() {
+	d.pingMutex.Lock()
+	if d.pingWaiting {
+		// previous ping still waiting for pong
+		d.pingMutex.Unlock()
+		return
+	}
+
+	d.pingWaiting = true
+	if servercfg.XPortPongTimeout > 0 {
+		d.pongTimer = time.AfterFunc(time.Duration(servercfg.XPortPongTimeout)*time.Second,
+			d.onPongTimeout)
+	}
+	d.pingMutex.Unlock()
+
+	// device echo the ping payload back in pong
+	msg := make([]byte, 9)
+	msg[0] = cmdPing
+	binary.LittleEndian.PutUint64(msg[1:], uint64(time.Now().UnixNano()))
+	d.sendMsg(msg)
+}
+
+func (d *XDevice) onPongTimeout() {
+	d.pingMutex.Lock()
+	waiting := d.pingWaiting
+	d.pingMutex.Unlock()
+
+	if waiting {
+		log.Printf("XDevice pong timeout, uuid:%s, close it", d.uuid)
+		d.close()
+	}
+}
+
+// onPong any pong proves the device alive, firmware may answer a bare pong
+// without echoing the payload, then rtt is not measured
+func (d *XDevice) onPong(message []byte) {
+	d.pingMutex.Lock()
+	defer d.pingMutex.Unlock()
+
+	if !d.pingWaiting {
+		return
+	}
+
+	d.pingWaiting = false
+	if d.pongTimer != nil {
+		d.pongTimer.Stop()
+		d.pongTimer = nil
+	}
+
+	if len(message) >= 9 {
+		sent := int64(binary.LittleEndian.Uint64(message[1:]))
+		d.rtt = time.Duration(time.Now().UnixNano() - sent)
+	}
+}
+
+// maxFrameData max data length in a request frame
+func (d *XDevice) maxFrameData() int {
+	if d.extended {
+		return maxExtMessageLength
+	}
+
+	return maxMessageLength
+}
+
+func (d *XDevice) getConn() *lws.Conn {
+	d.connMutex.Lock()
+	defer d.connMutex.Unlock()
+
+	return d.conn
+}
+
+// close close current lws link, a resumable session survives it
+func (d *XDevice) close() {
+	d.connMutex.Lock()
+	c := d.conn
 	d.conn = nil
+	d.connMutex.Unlock()
+
+	if c != nil {
+		c.Close()
+	}
+}
+
+// end remove device from registry and free all requests
+func (d *XDevice) end() {
+	devices.Remove(d)
+	d.failRPCCalls()
+	d.free()
+	d.sched.stop()
 }
 
 func (d *XDevice) free() {
-	for _, r := range d.requests {
+	for _, r := range d.allRequests() {
 		r.close()
 	}
 
 	log.Printf("XDevice free, uuid:%s", d.uuid)
 }
 
+// sendMsg queue a frame that is not bound to any request
 func (d *XDevice) sendMsg(msg []byte) {
-	if d.conn != nil {
-		err := d.conn.WriteMessage(msg)
-		if err != nil {
-			log.Println("XDevice sendMsg failed:", err)
-		}
+	d.sched.pushControl(msg)
+}
+
+// writeMsg queue a frame, fail if no lws link
+func (d *XDevice) writeMsg(msg []byte) error {
+	c := d.getConn()
+	if c == nil {
+		return fmt.Errorf("XDevice no lws link")
+	}
+
+	if len(msg) > c.MaxMessageLength() {
+		return fmt.Errorf("XDevice message too large:%d", len(msg))
 	}
+
+	d.sendMsg(msg)
+	return nil
 }
 
 func (d *XDevice) loopMsg() {
-	c := d.conn
-	for {
+	c := d.getConn()
+	linkCh := make(chan struct{})
+	go d.keepalive(linkCh)
+	if d.resumable {
+		go d.ackLoop(linkCh)
+	}
+
+	for c != nil {
+		if servercfg.XPortReadIdleTimeout > 0 {
+			c.SetReadDeadline(time.Now().Add(time.Duration(servercfg.XPortReadIdleTimeout) * time.Second))
+		}
+
 		message, err := c.ReadMessage()
 		if err != nil {
 			log.Println("read:", err)
@@ -68,15 +317,27 @@ func (d *XDevice) loopMsg() {
 		if cmd == cmdPing {
 			// log.Println("recv ping from peer, send pong")
 			message[0] = cmdPong
-			c.WriteMessage(message)
+			d.sendMsg(message)
 		} else if cmd == cmdPong {
-			// nothing to do
+			d.onPong(message)
+		} else if cmd == cmdRPCResponse {
+			d.onRPCResponse(message)
+		} else if cmd == cmdRPCRequest {
+			d.onRPCRequest(message)
 		} else {
 			d.handleRequestMsg(message)
 		}
 	}
 
-	d.free()
+	close(linkCh)
+
+	// keep requests for a while, device may resume the session
+	if d.detach() {
+		log.Printf("XDevice detached, uuid:%s, wait for resume", d.uuid)
+		return
+	}
+
+	d.end()
 }
 
 func (d *XDevice) handleRequestMsg(message []byte) {
@@ -95,16 +356,43 @@ func (d *XDevice) handleRequestMsg(message []byte) {
 		return
 	}
 
+	if cmd == cmdReqAck {
+		if len(message) < 9 {
+			log.Errorln("ack message len should >= 9")
+			return
+		}
+
+		req.onAck(binary.LittleEndian.Uint32(message[5:]))
+		return
+	}
+
+	if d.resumable {
+		req.onRecvFrame()
+	}
+
 	switch cmd {
 	case cmdReqServerFinished:
-		fallthrough
+		err := req.onServerFinished(requestTag)
+		if err != nil {
+			log.Println("req.onServerFinished failed:", err)
+			req.closeTag(requestTag)
+		}
 	case cmdReqServerClosed:
-		req.close()
+		req.onServerClosed(requestTag)
+	case cmdReqClientQuota:
+		if len(message) < 9 {
+			log.Errorln("quota message len should >= 9")
+			return
+		}
+
+		req.onQuota(binary.LittleEndian.Uint32(message[5:]))
+	case cmdReqDgram:
+		fallthrough
 	case cmdReqData:
-		err := req.onData(message[5:])
+		err := req.onData(requestTag, message[5:])
 		if err != nil {
 			log.Println("req.onData failed:", err)
-			req.close()
+			req.closeTag(requestTag)
 		}
 
 	default:
@@ -113,41 +401,45 @@ func (d *XDevice) handleRequestMsg(message []byte) {
 }
 
 func (d *XDevice) getRequest(requestIdx uint16, requestTag uint16) *XRequest {
-	if int(requestIdx) >= len(d.requests) {
-		return nil
-	}
-
-	req := d.requests[requestIdx]
-	if req == nil {
-		return nil
-	}
-
-	if req.tag != requestTag {
-		return nil
-	}
-
-	if !req.inUsed {
+	req := d.slot(requestIdx)
+	if req == nil || !req.isCurrent(requestTag) {
 		return nil
 	}
 
 	return req
 }
 
-func (d *XDevice) mountRequest(uuid string, targetPort uint16, conn *websocket.Conn) *XRequest {
-	var req *XRequest
-	for _, r := range d.requests {
-		if !r.inUsed {
-			req = r
-			break
-		}
+// mountRequest host is a target on device's LAN, empty means device itself
+func (d *XDevice) mountRequest(uuid string, host string, targetPort uint16, conn xclient, dgram bool) (*XRequest, error) {
+	return d.mountRequestWithPreface(uuid, host, targetPort, conn, dgram, nil)
+}
+
+// mountRequestWithPreface like mountRequest, preface is written to client
+// before any data from device, e.g. proxy success reply
+func (d *XDevice) mountRequestWithPreface(uuid string, host string, targetPort uint16, conn xclient,
+	dgram bool, preface []byte) (*XRequest, error) {
+	if host != "" && d.version < xportVersionLANHost {
+		return nil, errLANHostUnsupported
 	}
 
+	req := d.allocSlot()
 	if req == nil {
-		return nil
+		return nil, errNoFreeSlot
 	}
 
-	req.use(uuid, targetPort, conn, d)
+	// a detached session can't create request on device until resumed,
+	// and detach must see the request to pause it
+	d.connMutex.Lock()
+	if d.detached || d.shut {
+		d.connMutex.Unlock()
+		d.releaseSlot(req.idx)
+		return nil, errDeviceOffline
+	}
+
+	req.use(uuid, host, targetPort, conn, dgram, preface)
+	d.connMutex.Unlock()
+
 	req.xClientCreate()
 
-	return req
+	return req, nil
 }
@@ -0,0 +1,379 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"lproxy/server"
+	"lproxy/servercfg"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// http reverse proxy into device web, by path {XPortHTTPProxyPath}/{uuid}/{port}/...
+// or by host {uuid}.{XPortHTTPProxyDomain}, every connection to device web
+// is a XRequest
+
+const (
+	// httpProxyCookie holds client token after the first visit with 'ctok',
+	// browser can't set header when navigating
+	httpProxyCookie = "xport_ctok"
+)
+
+const (
+	tokenFromNone = iota
+	tokenFromQuery
+	tokenFromCookie
+	tokenFromHeader
+)
+
+type httpProxyTargetKey struct{}
+
+var (
+	// device web is dialed by target in request context, connections are not
+	// reused, an idle one would hold a request slot of device
+	httpProxyTransport = &http.Transport{
+		DialContext:       dialHTTPProxyTarget,
+		DisableKeepAlives: true,
+	}
+)
+
+// httpProxyTarget device web that a request is proxied to
+type httpProxyTarget struct {
+	uuid string
+	port uint16
+	// path prefix to strip in path mode, empty in host mode
+	prefix string
+	// scheme and host that client sees
+	scheme string
+	host   string
+
+	tokenFrom int
+}
+
+// httpClientToken get client token from query 'ctok', cookie or 'Authorization' header
+func httpClientToken(r *http.Request) (string, int) {
+	tk := r.URL.Query().Get("ctok")
+	if tk != "" {
+		return tk, tokenFromQuery
+	}
+
+	c, err := r.Cookie(httpProxyCookie)
+	if err == nil && c.Value != "" {
+		return c.Value, tokenFromCookie
+	}
+
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer "), tokenFromHeader
+	}
+
+	return "", tokenFromNone
+}
+
+func isUpgradeRequest(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// xportServeHTTPPath target is port number or service name of device
+func xportServeHTTPPath(ctx *server.RequestContext) {
+	uuid := ctx.Params.ByName("uuid")
+	target := ctx.Params.ByName("target")
+	prefix := strings.TrimSuffix(ctx.R.URL.Path, ctx.Params.ByName("path"))
+
+	serveHTTPProxy(ctx, uuid, target, prefix)
+}
+
+func xportServeHTTPHost(ctx *server.RequestContext) {
+	host := ctx.R.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	uuid := host[:len(host)-len(servercfg.XPortHTTPProxyDomain)-1]
+	if uuid == "" || strings.Contains(uuid, ".") {
+		replyError(ctx, http.StatusNotFound, "no dev uuid in host")
+		return
+	}
+
+	// browsers lowercase host, so uuid is matched regardless of case
+	if d := devices.GetFold(uuid); d != nil {
+		uuid = d.uuid
+	}
+
+	serveHTTPProxy(ctx, uuid, strconv.Itoa(servercfg.XPortHTTPProxyPort), "")
+}
+
+func serveHTTPProxy(ctx *server.RequestContext, uuid string, target string, prefix string) {
+	r := ctx.R
+	tk, from := httpClientToken(r)
+	account, ok := "", false
+	if tk != "" {
+		account, ok = server.VerifyClientTK(tk)
+	}
+
+	if !ok {
+		replyError(ctx, http.StatusUnauthorized, "invalid client token")
+		return
+	}
+
+	service, portStr := "", target
+	if _, err := strconv.Atoi(target); err != nil {
+		service, portStr = target, ""
+	}
+
+	port, code, reason := resolveTarget(uuid, "", service, portStr)
+	if code != http.StatusOK {
+		replyError(ctx, code, reason)
+		return
+	}
+
+	if !authorizeClient(account, uuid, "", int(port)) {
+		replyError(ctx, http.StatusForbidden, "not allowed to reach the device port")
+		return
+	}
+
+	if devices.Get(uuid) == nil {
+		// device may be held by other node
+		if clusterServeHTTP(ctx, uuid) {
+			return
+		}
+
+		replyError(ctx, http.StatusNotFound, "no dev found for uuid")
+		return
+	}
+
+	if from == tokenFromQuery {
+		cookiePath := "/"
+		if prefix != "" {
+			cookiePath = prefix + "/"
+		}
+
+		http.SetCookie(ctx.W, &http.Cookie{
+			Name:     httpProxyCookie,
+			Value:    tk,
+			Path:     cookiePath,
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		// keep token out of browser history and device logs
+		if (r.Method == "GET" || r.Method == "HEAD") && !isUpgradeRequest(r) {
+			u := *r.URL
+			query := u.Query()
+			query.Del("ctok")
+			u.RawQuery = query.Encode()
+			http.Redirect(ctx.W, r, u.RequestURI(), http.StatusFound)
+			return
+		}
+	}
+
+	t := &httpProxyTarget{
+		uuid:      uuid,
+		port:      port,
+		prefix:    prefix,
+		scheme:    "http",
+		host:      r.Host,
+		tokenFrom: from,
+	}
+
+	if r.TLS != nil {
+		t.scheme = "https"
+	}
+
+	ctx.Log.Printf("xport http proxy, account:%s, uuid:%s, port:%d, %s %s", account, uuid,
+		port, r.Method, r.URL.Path)
+
+	rp := &httputil.ReverseProxy{
+		Director:       t.director,
+		Transport:      httpProxyTransport,
+		ModifyResponse: t.modifyResponse,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			ctx.Log.Println("xport http proxy failed:", err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), httpProxyTargetKey{}, t))
+	rp.ServeHTTP(ctx.W, r)
+}
+
+func dialHTTPProxyTarget(ctx context.Context, network, addr string) (net.Conn, error) {
+	t, ok := ctx.Value(httpProxyTargetKey{}).(*httpProxyTarget)
+	if !ok {
+		return nil, fmt.Errorf("no http proxy target for %s", addr)
+	}
+
+	xdev := devices.Get(t.uuid)
+	if xdev == nil {
+		return nil, fmt.Errorf("no dev found for uuid:%s", t.uuid)
+	}
+
+	c1, c2 := newPipe(pipeAddr("http-proxy"))
+	xreq, err := xdev.mountRequest(t.uuid, "", t.port, newTCPClient(c1), false)
+	if err != nil {
+		c1.Close()
+		c2.Close()
+		return nil, err
+	}
+
+	go xreq.loopMsg()
+	return c2, nil
+}
+
+// deviceHost host of device web in its own view
+func (t *httpProxyTarget) deviceHost() string {
+	if t.port == 80 {
+		return "127.0.0.1"
+	}
+
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(int(t.port)))
+}
+
+// isDeviceHost whether hostport is a loopback address of target port
+func (t *httpProxyTarget) isDeviceHost(hostport string) bool {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = strings.Trim(hostport, "[]"), "80"
+	}
+
+	if port != strconv.Itoa(int(t.port)) {
+		return false
+	}
+
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (t *httpProxyTarget) director(r *http.Request) {
+	r.URL.Scheme = "http"
+	r.URL.Host = t.deviceHost()
+	r.Host = t.deviceHost()
+
+	if t.prefix != "" {
+		// strip prefix segments from escaped path, to keep encoding of the rest
+		rest := r.URL.EscapedPath()
+		for i := strings.Count(t.prefix, "/"); i > 0; i-- {
+			n := strings.Index(rest[1:], "/")
+			if n < 0 {
+				rest = "/"
+				break
+			}
+
+			rest = rest[n+1:]
+		}
+
+		path, err := url.PathUnescape(rest)
+		if err == nil {
+			r.URL.Path = path
+			r.URL.RawPath = rest
+		}
+	}
+
+	query := r.URL.Query()
+	if _, ok := query["ctok"]; ok {
+		query.Del("ctok")
+		r.URL.RawQuery = query.Encode()
+	}
+
+	// credentials of xport are not for device
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != httpProxyCookie {
+			r.AddCookie(c)
+		}
+	}
+
+	if t.tokenFrom == tokenFromHeader {
+		r.Header.Del("Authorization")
+	}
+
+	r.Header.Set("X-Forwarded-Host", t.host)
+	r.Header.Set("X-Forwarded-Proto", t.scheme)
+	if t.prefix != "" {
+		r.Header.Set("X-Forwarded-Prefix", t.prefix)
+	}
+}
+
+// modifyResponse rewrite redirect and cookies of device web to the view of client
+func (t *httpProxyTarget) modifyResponse(rsp *http.Response) error {
+	loc := rsp.Header.Get("Location")
+	if loc != "" {
+		rsp.Header.Set("Location", t.rewriteLocation(loc))
+	}
+
+	cookies := rsp.Cookies()
+	if len(cookies) > 0 {
+		rsp.Header.Del("Set-Cookie")
+		for _, c := range cookies {
+			t.rewriteCookie(c)
+			v := c.String()
+			if v != "" {
+				rsp.Header.Add("Set-Cookie", v)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (t *httpProxyTarget) rewriteLocation(loc string) string {
+	u, err := url.Parse(loc)
+	if err != nil {
+		return loc
+	}
+
+	if u.Host != "" {
+		// absolute url to other sites is kept
+		if !t.isDeviceHost(u.Host) {
+			return loc
+		}
+
+		if u.Scheme != "" {
+			u.Scheme = t.scheme
+		}
+
+		u.Host = t.host
+	}
+
+	// relative path is resolved by client
+	if t.prefix != "" && strings.HasPrefix(u.Path, "/") {
+		u.Path = t.prefix + u.Path
+		if u.RawPath != "" {
+			u.RawPath = t.prefix + u.RawPath
+		}
+	}
+
+	return u.String()
+}
+
+func (t *httpProxyTarget) rewriteCookie(c *http.Cookie) {
+	// domain of device means nothing to client
+	c.Domain = ""
+	if t.prefix != "" && strings.HasPrefix(c.Path, "/") {
+		c.Path = t.prefix + c.Path
+	}
+}
+
+func init() {
+	server.InvokeAfterCfgLoaded(func() {
+		if servercfg.XPortHTTPProxyPath != "" {
+			server.RegisterAnyHandleNoUUID(servercfg.XPortHTTPProxyPath+"/:uuid/:target/*path",
+				xportServeHTTPPath)
+		}
+
+		if servercfg.XPortHTTPProxyDomain != "" {
+			server.RegisterHostHandle("."+servercfg.XPortHTTPProxyDomain, xportServeHTTPHost)
+		}
+	})
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"lproxy/server"
+	"lproxy/servercfg"
+	"sync"
+	"time"
+)
+
+// tokenBucket bytes rate limiter, zero rate means unlimited
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(kbs int) *tokenBucket {
+	tb := &tokenBucket{}
+	tb.setKbs(kbs)
+	return tb
+}
+
+// setKbs change rate at runtime, in kilobytes per second
+func (tb *tokenBucket) setKbs(kbs int) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	if kbs <= 0 {
+		tb.rate = 0
+		return
+	}
+
+	unlimited := tb.rate == 0
+	tb.rate = float64(kbs) * 1024
+	// allow one second burst, but at least one full message
+	tb.burst = tb.rate
+	if tb.burst < maxMessageLength {
+		tb.burst = maxMessageLength
+	}
+
+	if unlimited || tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+
+	tb.last = time.Now()
+}
+
+func (tb *tokenBucket) kbs() int {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	return int(tb.rate / 1024)
+}
+
+// reserve take n bytes from bucket, return the duration that caller should wait
+func (tb *tokenBucket) reserve(n int) time.Duration {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	if tb.rate == 0 {
+		return 0
+	}
+
+	now := time.Now()
+	tb.tokens = tb.tokens + now.Sub(tb.last).Seconds()*tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+
+	// tokens may go negative, the following callers wait for the debt
+	tb.tokens = tb.tokens - float64(n)
+	if tb.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// bandwidthLimiter limit both directions, in device's view
+type bandwidthLimiter struct {
+	send *tokenBucket
+	recv *tokenBucket
+}
+
+func newBandwidthLimiter(kbs int) *bandwidthLimiter {
+	return &bandwidthLimiter{
+		send: newTokenBucket(kbs),
+		recv: newTokenBucket(kbs),
+	}
+}
+
+func (l *bandwidthLimiter) setKbs(kbs int) {
+	l.send.setKbs(kbs)
+	l.recv.setKbs(kbs)
+}
+
+func (l *bandwidthLimiter) kbs() int {
+	return l.send.kbs()
+}
+
+var (
+	globalLimiter = newBandwidthLimiter(0)
+
+	requestKbsMutex sync.Mutex
+	requestKbs      = 0
+
+	// deviceKbs limits set at runtime for devices, they survive reconnect and
+	// are not overwritten by config reload
+	deviceKbsMutex sync.Mutex
+	deviceKbs      = make(map[string]int)
+)
+
+// waitBuckets wait until all buckets allow n bytes
+func waitBuckets(n int, buckets ...*tokenBucket) {
+	var d time.Duration
+	for _, tb := range buckets {
+		w := tb.reserve(n)
+		if w > d {
+			d = w
+		}
+	}
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// waitSend shape bytes that device sent to client, on client writer, so a
+// limited request does not stall others of the device, device is held back
+// by the window of request, see xportsched.go
+func (r *XRequest) waitSend(n int) {
+	waitBuckets(n, globalLimiter.send, r.dev.limiter.send, r.limiter.send)
+}
+
+// waitRecv shape bytes that client sent to device
+func (r *XRequest) waitRecv(n int) {
+	waitBuckets(n, globalLimiter.recv, r.dev.limiter.recv, r.limiter.recv)
+}
+
+// SetGlobalBandwidth change the limit of all xport traffic, in kilobytes per second
+func SetGlobalBandwidth(kbs int) {
+	globalLimiter.setKbs(kbs)
+}
+
+// GetGlobalBandwidth get the limit of all xport traffic
+func GetGlobalBandwidth() int {
+	return globalLimiter.kbs()
+}
+
+// SetRequestBandwidth change the limit of each request, in kilobytes per second,
+// apply to all existing requests
+func SetRequestBandwidth(kbs int) {
+	requestKbsMutex.Lock()
+	requestKbs = kbs
+	requestKbsMutex.Unlock()
+
+	for _, d := range devices.List() {
+		for _, r := range d.allRequests() {
+			r.limiter.setKbs(kbs)
+		}
+	}
+}
+
+func getRequestBandwidth() int {
+	requestKbsMutex.Lock()
+	defer requestKbsMutex.Unlock()
+
+	return requestKbs
+}
+
+// SetDeviceBandwidth change the limit of device by uuid, in kilobytes per second,
+// apply to the online device and its future connections
+func SetDeviceBandwidth(uuid string, kbs int) {
+	deviceKbsMutex.Lock()
+	deviceKbs[uuid] = kbs
+	deviceKbsMutex.Unlock()
+
+	d := devices.Get(uuid)
+	if d != nil {
+		d.limiter.setKbs(kbs)
+	}
+}
+
+// GetDeviceBandwidth the limit of device by uuid, default to config
+func GetDeviceBandwidth(uuid string) int {
+	deviceKbsMutex.Lock()
+	defer deviceKbsMutex.Unlock()
+
+	kbs, ok := deviceKbs[uuid]
+	if ok {
+		return kbs
+	}
+
+	return servercfg.BandwidthKbs
+}
+
+// SetBandwidth change the limit of device, see SetDeviceBandwidth
+func (d *XDevice) SetBandwidth(kbs int) {
+	SetDeviceBandwidth(d.uuid, kbs)
+}
+
+// Bandwidth the limit of device
+func (d *XDevice) Bandwidth() int {
+	return d.limiter.kbs()
+}
+
+func applyBandwidthCfg() {
+	SetGlobalBandwidth(servercfg.XPortGlobalKbs)
+	SetRequestBandwidth(servercfg.XPortPerRequestKbs)
+
+	for _, d := range devices.List() {
+		d.limiter.setKbs(GetDeviceBandwidth(d.uuid))
+	}
+}
+
+func init() {
+	server.InvokeAfterCfgLoaded(func() {
+		applyBandwidthCfg()
+		servercfg.InvokeAfterCfgReloaded(applyBandwidthCfg)
+	})
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lproxy/server"
+	"lproxy/servercfg"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// NotifyType type of notification that server pushes to device
+type NotifyType byte
+
+const (
+	// NotifyCfgChanged device config has changed, device should pull it again
+	NotifyCfgChanged NotifyType = 1
+	// NotifyRestart device should restart
+	NotifyRestart NotifyType = 2
+	// NotifyUpgrade new firmware is available
+	NotifyUpgrade NotifyType = 3
+)
+
+// CfgChangedNotify payload of NotifyCfgChanged
+type CfgChangedNotify struct {
+	KbPerSecond uint64 `json:"kb_per_second"`
+	DomainsVer  string `json:"domains_ver"`
+}
+
+// RestartNotify payload of NotifyRestart
+type RestartNotify struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// FirmwareNotify firmware of an arch, device picks its own
+type FirmwareNotify struct {
+	Arch       string `json:"arch"`
+	NewVersion string `json:"new_version"`
+	UpgradeURL string `json:"upgrade_url"`
+}
+
+// UpgradeNotify payload of NotifyUpgrade
+type UpgradeNotify struct {
+	Firmwares []*FirmwareNotify `json:"firmwares"`
+}
+
+var (
+	// firmwares fingerprint of last push, upgrade is pushed only when it changes
+	lastFirmwaresMutex sync.Mutex
+	lastFirmwares      = ""
+
+	errNotifyUnsupported = errors.New("device does not support notify")
+)
+
+// Notify push a notification to device, message is
+// cmdNotify(1 byte) + type(1 byte) + json payload, device must
+// negotiate xportVersionNotify at least
+func (d *XDevice) Notify(t NotifyType, payload interface{}) error {
+	if d.version < xportVersionNotify {
+		return errNotifyUnsupported
+	}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	msg := make([]byte, 2+len(b))
+	msg[0] = cmdNotify
+	msg[1] = byte(t)
+	copy(msg[2:], b)
+
+	err = d.writeMsg(msg)
+	if err != nil {
+		return fmt.Errorf("notify device %s failed:%v", d.uuid, err)
+	}
+
+	log.Printf("XDevice notify, uuid:%s, type:%d", d.uuid, t)
+	return nil
+}
+
+// PushCfgChanged tell device its config has changed
+func (d *XDevice) PushCfgChanged() error {
+	return d.Notify(NotifyCfgChanged, &CfgChangedNotify{
+		KbPerSecond: uint64(GetDeviceBandwidth(d.uuid)),
+		DomainsVer:  servercfg.DomainsCfgVerStr,
+	})
+}
+
+// PushRestart ask device to restart
+func (d *XDevice) PushRestart(reason string) error {
+	return d.Notify(NotifyRestart, &RestartNotify{Reason: reason})
+}
+
+// PushUpgrade tell device the firmwares available
+func (d *XDevice) PushUpgrade() error {
+	return d.Notify(NotifyUpgrade, &UpgradeNotify{Firmwares: firmwares()})
+}
+
+func firmwares() []*FirmwareNotify {
+	list := make([]*FirmwareNotify, 0, len(servercfg.FirmwareMap))
+	for _, fm := range servercfg.FirmwareMap {
+		list = append(list, &FirmwareNotify{
+			Arch:       fm.Arch,
+			NewVersion: fm.NewVersionStr,
+			UpgradeURL: fm.UpgradeURL,
+		})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Arch < list[j].Arch
+	})
+
+	return list
+}
+
+func firmwaresFingerprint() string {
+	var sb strings.Builder
+	for _, f := range firmwares() {
+		sb.WriteString(fmt.Sprintf("%s@%s@%s;", f.Arch, f.NewVersion, f.UpgradeURL))
+	}
+
+	return sb.String()
+}
+
+// onCfgReloaded push config changed to all online devices, and upgrade
+// if firmwares changed
+func onCfgReloaded() {
+	fp := firmwaresFingerprint()
+	lastFirmwaresMutex.Lock()
+	upgrade := fp != lastFirmwares
+	lastFirmwares = fp
+	lastFirmwaresMutex.Unlock()
+
+	for _, d := range devices.List() {
+		if d.Detached() || d.version < xportVersionNotify {
+			continue
+		}
+
+		err := d.PushCfgChanged()
+		if err != nil {
+			log.Println("push cfg changed after reload,", err)
+		}
+
+		if upgrade {
+			err = d.PushUpgrade()
+			if err != nil {
+				log.Println("push upgrade after reload,", err)
+			}
+		}
+	}
+}
+
+func init() {
+	server.InvokeAfterCfgLoaded(func() {
+		lastFirmwaresMutex.Lock()
+		lastFirmwares = firmwaresFingerprint()
+		lastFirmwaresMutex.Unlock()
+
+		servercfg.InvokeAfterCfgReloaded(onCfgReloaded)
+	})
+}
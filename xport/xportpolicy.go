@@ -0,0 +1,167 @@
+package server
+
+import (
+	"fmt"
+	"lproxy/servercfg"
+	"lproxy/xport/lanhost"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// max length of hostname in create command
+	maxLANHostLength = 255
+)
+
+// findPolicy find policy for device, a policy lists the device explicitly
+// takes precedence over the wildcard one
+func findPolicy(uuid string) *servercfg.XPortPolicy {
+	var wildcard *servercfg.XPortPolicy
+	for _, p := range servercfg.XPortPolicies {
+		for _, d := range p.Devices {
+			if d == uuid {
+				return p
+			}
+
+			if d == "*" && wildcard == nil {
+				wildcard = p
+			}
+		}
+	}
+
+	return wildcard
+}
+
+// checkPolicy check whether the port of device is reachable
+func checkPolicy(uuid string, port int) error {
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("port %d out of range", port)
+	}
+
+	if len(servercfg.XPortPolicies) == 0 {
+		return nil
+	}
+
+	p := findPolicy(uuid)
+	if p == nil {
+		return fmt.Errorf("no policy for device %s", uuid)
+	}
+
+	for _, sp := range p.Services {
+		if sp == port {
+			return nil
+		}
+	}
+
+	if containsPort(p.Ports, port) {
+		return nil
+	}
+
+	return fmt.Errorf("port %d not allowed by policy %s", port, p.Name)
+}
+
+// checkLANPolicy check whether the target on device's LAN is reachable,
+// unlike device ports, LAN is unreachable unless a policy allows it
+func checkLANPolicy(uuid string, host string, port int) error {
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("port %d out of range", port)
+	}
+
+	err := validLANHost(host)
+	if err != nil {
+		return err
+	}
+
+	p := findPolicy(uuid)
+	if p == nil {
+		return fmt.Errorf("no policy for device %s", uuid)
+	}
+
+	if !lanhost.Match(p.LANHosts, host) {
+		return fmt.Errorf("host %s not allowed by policy %s", host, p.Name)
+	}
+
+	if len(p.LANPorts) > 0 && !containsPort(p.LANPorts, port) {
+		return fmt.Errorf("port %d of host %s not allowed by policy %s", port, host, p.Name)
+	}
+
+	return nil
+}
+
+// validLANHost host should be an ip or a hostname, it is resolved by device
+func validLANHost(host string) error {
+	if host == "" || len(host) > maxLANHostLength {
+		return fmt.Errorf("invalid host length:%d", len(host))
+	}
+
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+
+	for _, c := range host {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(c >= '0' && c <= '9') || c == '-' || c == '.' || c == '_' {
+			continue
+		}
+
+		return fmt.Errorf("invalid host:%s", host)
+	}
+
+	return nil
+}
+
+// resolveTarget resolve target port from 'service' or 'port' query, and check it
+// against device policy, target on device's LAN if host is not empty,
+// return port, or http status code with reason
+func resolveTarget(uuid string, host string, service string, portStr string) (uint16, int, string) {
+	if host != "" && service != "" {
+		return 0, http.StatusBadRequest, "service can't be used with host"
+	}
+
+	var port int
+	if service != "" {
+		if portStr != "" {
+			return 0, http.StatusBadRequest, "either port or service should be provided"
+		}
+
+		p := findPolicy(uuid)
+		if p == nil {
+			return 0, http.StatusForbidden, "no policy for device"
+		}
+
+		sp, ok := p.Services[service]
+		if !ok {
+			return 0, http.StatusNotFound, "no service found: " + service
+		}
+
+		port = sp
+	} else {
+		if portStr == "" {
+			return 0, http.StatusBadRequest, "no port or service provided"
+		}
+
+		var err error
+		port, err = strconv.Atoi(portStr)
+		if err != nil {
+			return 0, http.StatusBadRequest, "convert port failed"
+		}
+	}
+
+	if port <= 0 || port > 65535 {
+		return 0, http.StatusBadRequest, "port out of range"
+	}
+
+	var err error
+	if host != "" {
+		err = checkLANPolicy(uuid, host, port)
+	} else {
+		err = checkPolicy(uuid, port)
+	}
+
+	if err != nil {
+		return 0, http.StatusForbidden, err.Error()
+	}
+
+	return uint16(port), http.StatusOK, ""
+}
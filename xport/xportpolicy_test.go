@@ -0,0 +1,75 @@
+package server
+
+import (
+	"lproxy/servercfg"
+	"net/http"
+	"testing"
+)
+
+// TestResolveTarget ports of device and hosts on its LAN allowed or denied
+// by policies
+func TestResolveTarget(t *testing.T) {
+	policies := servercfg.XPortPolicies
+	defer func() { servercfg.XPortPolicies = policies }()
+
+	// no policy, any port of device but no LAN host
+	servercfg.XPortPolicies = nil
+	if port, code, _ := resolveTarget("dev-a", "", "", "8080"); port != 8080 || code != http.StatusOK {
+		t.Fatal("port should be allowed without policy, got:", code)
+	}
+
+	if _, code, _ := resolveTarget("dev-a", "192.168.1.2", "", "80"); code != http.StatusForbidden {
+		t.Fatal("LAN host should be denied without policy, got:", code)
+	}
+
+	servercfg.XPortPolicies = []*servercfg.XPortPolicy{
+		{
+			Name:     "any",
+			Devices:  []string{"*"},
+			Services: map[string]int{"ssh": 22},
+		},
+		{
+			Name:     "dev-a",
+			Devices:  []string{"dev-a"},
+			Services: map[string]int{"web": 80},
+			Ports:    []int{8080},
+			LANHosts: []string{"192.168.1.0/24", "*.lan"},
+			LANPorts: []int{80, 443},
+		},
+	}
+
+	cases := []struct {
+		uuid    string
+		host    string
+		service string
+		port    string
+		want    uint16
+		code    int
+	}{
+		{"dev-a", "", "web", "", 80, http.StatusOK},
+		{"dev-a", "", "", "80", 80, http.StatusOK},
+		{"dev-a", "", "", "8080", 8080, http.StatusOK},
+		{"dev-a", "", "", "22", 0, http.StatusForbidden},
+		{"dev-a", "", "ssh", "", 0, http.StatusNotFound},
+		{"dev-b", "", "ssh", "", 22, http.StatusOK},
+		{"dev-b", "", "", "8080", 0, http.StatusForbidden},
+		{"dev-a", "", "web", "80", 0, http.StatusBadRequest},
+		{"dev-a", "", "", "", 0, http.StatusBadRequest},
+		{"dev-a", "", "", "65536", 0, http.StatusBadRequest},
+		{"dev-a", "192.168.1.2", "", "443", 443, http.StatusOK},
+		{"dev-a", "nas.lan", "", "80", 80, http.StatusOK},
+		{"dev-a", "192.168.2.2", "", "80", 0, http.StatusForbidden},
+		{"dev-a", "192.168.1.2", "", "22", 0, http.StatusForbidden},
+		{"dev-a", "bad host", "", "80", 0, http.StatusForbidden},
+		{"dev-a", "192.168.1.2", "web", "", 0, http.StatusBadRequest},
+		{"dev-b", "192.168.1.2", "", "80", 0, http.StatusForbidden},
+	}
+
+	for _, c := range cases {
+		port, code, reason := resolveTarget(c.uuid, c.host, c.service, c.port)
+		if port != c.want || code != c.code {
+			t.Errorf("%s host:%q service:%q port:%q, got:%d %d %s, want:%d %d",
+				c.uuid, c.host, c.service, c.port, port, code, reason, c.want, c.code)
+		}
+	}
+}
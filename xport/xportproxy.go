@@ -0,0 +1,126 @@
+package server
+
+import (
+	"lproxy/server"
+	"lproxy/servercfg"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// socks5 and http connect front-ends, destination {uuid}.xport:{port} is the
+// device itself, otherwise user is the device uuid, and destination is a host
+// on its LAN, the password is client token
+
+const (
+	proxyDeviceSuffix = ".xport"
+
+	// client must finish handshake in time
+	proxyHandshakeTimeout = 10 * time.Second
+)
+
+// proxyTarget destination of socks5 or http connect
+type proxyTarget struct {
+	account string
+	uuid    string
+	// empty means device itself
+	host string
+	port uint16
+}
+
+// resolveProxyTarget resolve and authorize destination,
+// return http status code with reason if failed
+func resolveProxyTarget(account string, user string, destHost string, destPort int) (*proxyTarget, int, string) {
+	uuid, host := "", ""
+	if strings.HasSuffix(destHost, proxyDeviceSuffix) {
+		uuid = strings.TrimSuffix(destHost, proxyDeviceSuffix)
+	} else {
+		uuid = user
+		host = destHost
+		if strings.EqualFold(host, "localhost") {
+			host = ""
+		} else if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+			host = ""
+		}
+	}
+
+	if uuid == "" {
+		return nil, http.StatusBadRequest, "no dev uuid provided"
+	}
+
+	port, code, reason := resolveTarget(uuid, host, "", strconv.Itoa(destPort))
+	if code != http.StatusOK {
+		return nil, code, reason
+	}
+
+	if !authorizeClient(account, uuid, host, int(port)) {
+		return nil, http.StatusForbidden, "not allowed to reach the device port"
+	}
+
+	if devices.Get(uuid) == nil {
+		return nil, http.StatusNotFound, "no dev found for uuid"
+	}
+
+	return &proxyTarget{account: account, uuid: uuid, host: host, port: port}, http.StatusOK, ""
+}
+
+// mount conn to device as a request, reply is written to conn before
+// any data from device
+func (t *proxyTarget) mount(conn net.Conn, reply []byte) (*XRequest, error) {
+	xdev := devices.Get(t.uuid)
+	if xdev == nil {
+		return nil, errDeviceOffline
+	}
+
+	return xdev.mountRequestWithPreface(t.uuid, t.host, t.port, newTCPClient(conn), false, reply)
+}
+
+// serveProxyListener accept until listener closed
+func serveProxyListener(ln net.Listener, name string, handle func(net.Conn)) {
+	log.Printf("xport %s proxy listen at:%s", name, ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+
+			log.Printf("xport %s proxy accept end:%v", name, err)
+			return
+		}
+
+		go handle(conn)
+	}
+}
+
+// listenProxy start a front-end if listen address is configured
+func listenProxy(listen string, name string, handle func(net.Conn)) {
+	if listen == "" {
+		return
+	}
+
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.Printf("xport %s proxy listen %s failed:%v", name, listen, err)
+		return
+	}
+
+	if addr, ok := ln.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() {
+		log.Printf("warning: xport %s proxy listen at non-loopback %s, client token is sent in clear, "+
+			"it should be behind TLS", name, ln.Addr())
+	}
+
+	go serveProxyListener(ln, name, handle)
+}
+
+func init() {
+	server.InvokeAfterCfgLoaded(func() {
+		listenProxy(servercfg.XPortSocksListen, "socks5", serveSocksConn)
+		listenProxy(servercfg.XPortConnectListen, "http connect", serveConnectConn)
+	})
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"strings"
+	"sync"
+)
+
+// DeviceEventType device lifecycle event type
+type DeviceEventType int
+
+const (
+	// DeviceOnline device lws link has been established
+	DeviceOnline DeviceEventType = iota
+	// DeviceOffline device lws link has been closed or replaced
+	DeviceOffline
+)
+
+func (t DeviceEventType) String() string {
+	switch t {
+	case DeviceOnline:
+		return "online"
+	case DeviceOffline:
+		return "offline"
+	default:
+		return "unknown"
+	}
+}
+
+// DeviceEvent device lifecycle event
+type DeviceEvent struct {
+	Type   DeviceEventType
+	UUID   string
+	Device *XDevice
+}
+
+// DeviceEventHandle device event subscriber, it is called in order and
+// must not block, subscribe or unsubscribe
+type DeviceEventHandle func(*DeviceEvent)
+
+// DeviceRegistry goroutine-safe registry of online devices
+type DeviceRegistry struct {
+	mutex   sync.Mutex
+	devices map[string]*XDevice
+	// events queued under mutex in the order of changes
+	events []*DeviceEvent
+
+	// notifyMutex delivers queued events one by one, it is not held with
+	// mutex, so subscribers may call registry
+	notifyMutex sync.Mutex
+	subscribers map[int]DeviceEventHandle
+	nextSubID   int
+}
+
+func newDeviceRegistry() *DeviceRegistry {
+	return &DeviceRegistry{
+		devices:     make(map[string]*XDevice),
+		subscribers: make(map[int]DeviceEventHandle),
+	}
+}
+
+// GetDeviceRegistry get the online devices registry
+func GetDeviceRegistry() *DeviceRegistry {
+	return devices
+}
+
+// Get get online device by uuid, nil if not found
+func (reg *DeviceRegistry) Get(uuid string) *XDevice {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	return reg.devices[uuid]
+}
+
+// GetFold get online device by uuid regardless of case, exact match is preferred
+func (reg *DeviceRegistry) GetFold(uuid string) *XDevice {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	d, ok := reg.devices[uuid]
+	if ok {
+		return d
+	}
+
+	for id, d := range reg.devices {
+		if strings.EqualFold(id, uuid) {
+			return d
+		}
+	}
+
+	return nil
+}
+
+// List snapshot of all online devices
+func (reg *DeviceRegistry) List() []*XDevice {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	list := make([]*XDevice, 0, len(reg.devices))
+	for _, d := range reg.devices {
+		list = append(list, d)
+	}
+
+	return list
+}
+
+// Count online devices count
+func (reg *DeviceRegistry) Count() int {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	return len(reg.devices)
+}
+
+// Replace put device into registry, return the old one with the same uuid if exist
+func (reg *DeviceRegistry) Replace(d *XDevice) *XDevice {
+	reg.mutex.Lock()
+	old := reg.devices[d.uuid]
+	reg.devices[d.uuid] = d
+	if old != nil {
+		reg.events = append(reg.events, &DeviceEvent{Type: DeviceOffline, UUID: old.uuid, Device: old})
+	}
+
+	reg.events = append(reg.events, &DeviceEvent{Type: DeviceOnline, UUID: d.uuid, Device: d})
+	reg.mutex.Unlock()
+
+	reg.notify()
+
+	return old
+}
+
+// Remove remove device from registry, only if it has not been replaced
+func (reg *DeviceRegistry) Remove(d *XDevice) bool {
+	reg.mutex.Lock()
+	current, ok := reg.devices[d.uuid]
+	if !ok || current != d {
+		reg.mutex.Unlock()
+		return false
+	}
+
+	delete(reg.devices, d.uuid)
+	reg.events = append(reg.events, &DeviceEvent{Type: DeviceOffline, UUID: d.uuid, Device: d})
+	reg.mutex.Unlock()
+
+	reg.notify()
+
+	return true
+}
+
+// Subscribe register a device event handle, return a func to unsubscribe
+func (reg *DeviceRegistry) Subscribe(handle DeviceEventHandle) func() {
+	reg.notifyMutex.Lock()
+	defer reg.notifyMutex.Unlock()
+
+	id := reg.nextSubID
+	reg.nextSubID++
+	reg.subscribers[id] = handle
+
+	return func() {
+		reg.notifyMutex.Lock()
+		defer reg.notifyMutex.Unlock()
+
+		delete(reg.subscribers, id)
+	}
+}
+
+// notify deliver queued events in order, events queued by others while
+// delivering are delivered too
+func (reg *DeviceRegistry) notify() {
+	reg.notifyMutex.Lock()
+	defer reg.notifyMutex.Unlock()
+
+	for {
+		reg.mutex.Lock()
+		if len(reg.events) == 0 {
+			reg.mutex.Unlock()
+			return
+		}
+
+		ev := reg.events[0]
+		reg.events = reg.events[1:]
+		reg.mutex.Unlock()
+
+		for _, handle := range reg.subscribers {
+			handle(ev)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestRegistryEventOrder subscribers see offline of a device before online of
+// its replacement, even when Remove races with Replace
+func TestRegistryEventOrder(t *testing.T) {
+	reg := newDeviceRegistry()
+
+	var online *XDevice
+	var violations int
+	reg.Subscribe(func(ev *DeviceEvent) {
+		switch ev.Type {
+		case DeviceOnline:
+			if online != nil {
+				violations++
+			}
+
+			online = ev.Device
+		case DeviceOffline:
+			if online != ev.Device {
+				violations++
+			}
+
+			online = nil
+		}
+	})
+
+	for i := 0; i < 10000; i++ {
+		old := &XDevice{uuid: "dev-race"}
+		reg.Replace(old)
+
+		new := &XDevice{uuid: "dev-race"}
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			reg.Remove(old)
+			wg.Done()
+		}()
+		go func() {
+			reg.Replace(new)
+			wg.Done()
+		}()
+		wg.Wait()
+
+		if online != reg.Get("dev-race") {
+			t.Fatal("last event does not match registry")
+		}
+
+		reg.Remove(new)
+	}
+
+	if violations > 0 {
+		t.Fatal("events out of order:", violations)
+	}
+}
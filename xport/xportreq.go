@@ -3,135 +3,590 @@ package server
 import (
 	"encoding/binary"
 	"fmt"
+	"lproxy/servercfg"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	maxMessageLength = (8*1024 - 2)
+	// max data length in a frame to device, larger client message is split,
+	// device that negotiated lws extended length mode accepts larger frame
+	maxMessageLength    = (8*1024 - 2)
+	maxExtMessageLength = 64 * 1024
+)
+
+// address types in cmdReqHostCreated, same as socks5
+const (
+	lanHostIPv4 = 1
+	lanHostName = 3
+	lanHostIPv6 = 4
 )
 
 // XRequest device
 type XRequest struct {
+	idx uint16
+	// the slot belongs to one device for its lifetime
+	dev *XDevice
+
+	// mutex guards the state of current use, from use to free
+	mutex  sync.Mutex
 	uuid   string
+	host   string
 	port   uint16
-	conn   *websocket.Conn
-	idx    uint16
+	conn   xclient
 	tag    uint16
 	inUsed bool
-	dev    *XDevice
+
+	// flow control, quota is the bytes count that device allow us to send,
+	// quotaCond waits on mutex
+	quotaEnabled bool
+	quota        int
+	quotaCond    *sync.Cond
+
+	// half-close state
+	clientFinished bool
+	serverFinished bool
+
+	// datagram mode, keep message boundaries, closed when idle timeout
+	dgram      bool
+	lastActive int64
+	idleTimer  *time.Timer
+
+	createdAt time.Time
+	traffic   trafficCounter
+	limiter   *bandwidthLimiter
+
+	// session resumption, frames sent to device are kept until acked,
+	// see xportsession.go
+	replayCond  *sync.Cond
+	frames      [][]byte
+	replayBytes int
+	sentSeq     uint32
+	recvSeq     uint32
+	ackedRecv   uint32
+	paused      bool
+
+	// frames queued to device, guarded by device writeScheduler, see xportsched.go
+	wq      [][]byte
+	wqBytes int
+	wqReady bool
+
+	// data queued to client
+	cw *clientWriter
+}
+
+func newXRequest(dev *XDevice, idx uint16) *XRequest {
+	r := &XRequest{
+		idx:        idx,
+		dev:        dev,
+		replayCond: sync.NewCond(&sync.Mutex{}),
+		limiter:    newBandwidthLimiter(getRequestBandwidth()),
+	}
+
+	r.quotaCond = sync.NewCond(&r.mutex)
+	return r
+}
+
+// isUsed whether request is in use
+func (r *XRequest) isUsed() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.inUsed
+}
+
+// currentTag tag of current use, false if request is not in use
+func (r *XRequest) currentTag() (uint16, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.tag, r.inUsed
+}
+
+// isCurrent whether request is still in the use of tag
+func (r *XRequest) isCurrent(tag uint16) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.inUsed && r.tag == tag
+}
+
+// client conn of current use, nil if closed
+func (r *XRequest) client() xclient {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.conn
+}
+
+// writer client writer of the use of tag, nil if closed, or the request
+// has been freed and reused
+func (r *XRequest) writer(tag uint16) *clientWriter {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.conn == nil || !r.inUsed || r.tag != tag {
+		return nil
+	}
+
+	return r.cw
+}
+
+// setClientFinished mark client side finished, return whether it has been
+// finished already, and whether server side has finished
+func (r *XRequest) setClientFinished() (bool, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	already := r.clientFinished
+	r.clientFinished = true
+	return already, r.serverFinished
+}
+
+// setServerFinished mark server side of the use of tag finished, return
+// whether client side has finished
+func (r *XRequest) setServerFinished(tag uint16) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.inUsed || r.tag != tag {
+		return false
+	}
+
+	r.serverFinished = true
+	return r.clientFinished
+}
+
+func (r *XRequest) isClientFinished() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.clientFinished
 }
 
-func (r *XRequest) onData(data []byte) error {
-	if r.conn != nil {
-		return r.conn.WriteMessage(websocket.BinaryMessage, data)
+func (r *XRequest) onData(tag uint16, data []byte) error {
+	cw := r.writer(tag)
+	if cw == nil {
+		return fmt.Errorf("XRequest no conn")
+	}
+
+	if cw.dgram {
+		r.touch()
 	}
 
-	return fmt.Errorf("XRequest no conn")
+	return cw.push(clientOpData, data)
 }
 
+// close close client conn, loopMsg then frees the request, it is safe to
+// call close more than once
 func (r *XRequest) close() {
-	if r.conn != nil {
-		r.conn.Close()
+	r.mutex.Lock()
+	c := r.takeConn()
+	r.mutex.Unlock()
+
+	r.closeConn(c)
+}
+
+// closeTag close request if it is still in the use of tag, it may have been
+// freed and reused by others
+func (r *XRequest) closeTag(tag uint16) {
+	var c xclient
+	r.mutex.Lock()
+	if r.inUsed && r.tag == tag {
+		c = r.takeConn()
 	}
+	r.mutex.Unlock()
 
+	r.closeConn(c)
+}
+
+// takeConn must hold mutex
+func (r *XRequest) takeConn() xclient {
+	c := r.conn
 	r.conn = nil
+	// wakeup loopMsg if it is waiting for quota
+	r.quotaCond.Broadcast()
+
+	return c
 }
 
-func (r *XRequest) free() {
-	if r.conn != nil {
-		r.conn.Close()
+func (r *XRequest) closeConn(c xclient) {
+	if c == nil {
+		return
+	}
+
+	c.close()
+
+	// wakeup loopMsg if it is waiting for ack
+	r.replayCond.L.Lock()
+	r.replayCond.Broadcast()
+	r.replayCond.L.Unlock()
+}
+
+// onServerFinished device has shutdown its write side, forward the FIN to
+// client after queued data, request is closed if both sides have finished
+func (r *XRequest) onServerFinished(tag uint16) error {
+	cw := r.writer(tag)
+	if cw == nil {
+		return fmt.Errorf("XRequest no conn")
+	}
+
+	return cw.push(clientOpCloseWrite, nil)
+}
+
+// onServerClosed device has closed the request, close it after queued data
+func (r *XRequest) onServerClosed(tag uint16) {
+	cw := r.writer(tag)
+	if cw == nil || cw.push(clientOpClose, nil) != nil {
+		r.closeTag(tag)
+	}
+}
+
+func (r *XRequest) onQuota(quota uint32) {
+	r.quotaCond.L.Lock()
+	r.quota = r.quota + int(quota)
+	r.quotaCond.Broadcast()
+	r.quotaCond.L.Unlock()
+}
+
+// waitQuota block until device grant some quota or request closed,
+// return false if request has been closed
+func (r *XRequest) waitQuota() bool {
+	r.quotaCond.L.Lock()
+	defer r.quotaCond.L.Unlock()
+
+	for r.quotaEnabled && !r.clientFinished && r.quota <= 0 && r.conn != nil {
+		r.quotaCond.Wait()
+	}
+
+	return r.conn != nil
+}
+
+// consumeQuota wait for quota then consume at most want bytes,
+// return the bytes count allow to send, 0 if request has been closed
+func (r *XRequest) consumeQuota(want int) int {
+	if !r.waitQuota() {
+		return 0
 	}
 
+	if !r.quotaEnabled {
+		return want
+	}
+
+	r.quotaCond.L.Lock()
+	defer r.quotaCond.L.Unlock()
+
+	n := want
+	if n > r.quota {
+		n = r.quota
+	}
+
+	r.quota = r.quota - n
+	return n
+}
+
+func (r *XRequest) free() {
+	r.mutex.Lock()
+	c := r.conn
+	cw := r.cw
+	idleTimer := r.idleTimer
+	createdAt := r.createdAt
+	usedTag := r.tag
 	r.inUsed = false
 	r.conn = nil
-	r.tag++
+	r.cw = nil
+	r.idleTimer = nil
+	r.tag = nextTag(r.tag)
 	r.uuid = ""
-	r.dev = nil
+	tag := r.tag
+	r.mutex.Unlock()
+
+	if c != nil {
+		c.close()
+	}
+
+	if cw != nil {
+		cw.stop()
+	}
 
-	log.Printf("xrequest free, idx:%d, tag:%d", r.idx, r.tag)
+	if idleTimer != nil {
+		idleTimer.Stop()
+	}
+
+	// frames of a paused request are dropped, including its close
+	if r.isPaused() {
+		r.dev.onPausedFree(r.idx, usedTag)
+	}
+
+	r.resetReplay()
+
+	atomic.AddInt64(&r.dev.sessionsDuration, int64(time.Since(createdAt)))
+	r.dev.releaseSlot(r.idx)
+
+	log.Printf("xrequest free, idx:%d, tag:%d", r.idx, tag)
 }
 
-func (r *XRequest) use(uuid string, port uint16, conn *websocket.Conn, dev *XDevice) {
-	r.dev = dev
+func (r *XRequest) use(uuid string, host string, port uint16, conn xclient, dgram bool, preface []byte) {
+	r.traffic.reset()
+	r.limiter.setKbs(getRequestBandwidth())
+	r.resetReplay()
+	atomic.AddUint64(&r.dev.sessions, 1)
+
+	r.mutex.Lock()
 	r.inUsed = true
 	r.uuid = uuid
-	r.tag++
+	r.host = host
+	r.tag = nextTag(r.tag)
 	r.conn = conn
 	r.port = port
+	r.cw = newClientWriter(r, conn, r.tag, dgram)
+	r.clientFinished = false
+	r.serverFinished = false
+	r.dgram = dgram
+	r.createdAt = time.Now()
+
+	// datagram can't be split, flow control is not applied to it
+	r.quotaEnabled = r.dev.quota > 0 && !dgram
+	r.quota = r.dev.quota
+	cw := r.cw
+	r.mutex.Unlock()
+
+	// queued before device knows the request, nothing goes ahead of it
+	if len(preface) > 0 {
+		cw.push(clientOpData, preface)
+	}
+
+	go cw.loop()
+}
+
+func (r *XRequest) touch() {
+	atomic.StoreInt64(&r.lastActive, time.Now().UnixNano())
+}
+
+// startIdleTimer close datagram request if no data in both directions
+// for XPortDgramIdleTimeout
+func (r *XRequest) startIdleTimer() {
+	idle := time.Duration(servercfg.XPortDgramIdleTimeout) * time.Second
+	if idle <= 0 {
+		return
+	}
+
+	r.touch()
+
+	r.mutex.Lock()
+	tag := r.tag
+	r.idleTimer = time.AfterFunc(idle, func() {
+		r.checkIdle(tag, idle)
+	})
+	r.mutex.Unlock()
+}
+
+// checkIdle close the use of tag if it has been idle, otherwise check it later
+func (r *XRequest) checkIdle(tag uint16, idle time.Duration) {
+	r.mutex.Lock()
+	if !r.inUsed || r.tag != tag {
+		r.mutex.Unlock()
+		return
+	}
+
+	last := atomic.LoadInt64(&r.lastActive)
+	elapsed := time.Duration(time.Now().UnixNano() - last)
+	if elapsed < idle {
+		r.idleTimer = time.AfterFunc(idle-elapsed, func() {
+			r.checkIdle(tag, idle)
+		})
+		r.mutex.Unlock()
+		return
+	}
+
+	c := r.takeConn()
+	r.mutex.Unlock()
+
+	log.Printf("xrequest datagram idle timeout, idx:%d, tag:%d", r.idx, tag)
+	r.closeConn(c)
 }
 
 func (r *XRequest) loopMsg() {
-	c := r.conn
+	c := r.client()
 	if c == nil {
 		log.Println("xrequest loopmsg failed, nil conn")
 		return
 	}
 
+	if r.dgram {
+		r.startIdleTimer()
+	}
+
 	for {
-		_, message, err := c.ReadMessage()
+		// stop reading from websocket until device grant more quota
+		if !r.waitQuota() {
+			log.Println("xrequest closed while waiting quota")
+			break
+		}
+
+		message, err := c.readMessage()
 		if err != nil {
-			log.Println("xrequest websocket read:", err)
+			log.Println("xrequest client read:", err)
 			break
 		}
 
-		if len(message) > maxMessageLength {
-			log.Println("xrequest message too large, must not great than:", maxMessageLength)
+		if r.dgram {
+			if len(message) > r.dev.maxFrameData() {
+				log.Println("xrequest datagram too large, drop it")
+				continue
+			}
+
+			r.touch()
+			r.xClientData(message)
+			continue
+		}
+
+		if len(message) == 0 {
+			// client shutdown its write side
+			already, serverFinished := r.setClientFinished()
+			if already {
+				continue
+			}
+
+			r.xClientFinished()
+			if serverFinished {
+				// both sides have finished
+				break
+			}
+
+			continue
+		}
+
+		if r.isClientFinished() {
+			log.Println("xrequest recv data after finished")
 			break
 		}
 
-		r.xClientData(message)
+		if !r.sendWithQuota(message) {
+			log.Println("xrequest closed while sending data")
+			break
+		}
 	}
 
 	r.xClientClosed()
 	r.free()
 }
 
-// xClientData x means exchange, send to server
-func (r *XRequest) xClientData(message []byte) {
-	if r.dev == nil {
-		log.Println("failed to send client data, xdev is nil")
-		return
+// sendWithQuota split message into pieces that fit in quota and frame, send them to device
+func (r *XRequest) sendWithQuota(message []byte) bool {
+	max := r.dev.maxFrameData()
+	for len(message) > 0 {
+		want := len(message)
+		if want > max {
+			want = max
+		}
+
+		n := r.consumeQuota(want)
+		if n == 0 {
+			return false
+		}
+
+		r.xClientData(message[:n])
+		message = message[n:]
 	}
 
-	dev := r.dev
+	return true
+}
+
+// xClientData x means exchange, send to server
+func (r *XRequest) xClientData(message []byte) {
+	r.waitRecv(len(message))
+	r.onRecv(len(message))
+	r.dev.sched.waitSpace(r)
 	new := make([]byte, 5+len(message))
 	new[0] = cmdReqData
+	if r.dgram {
+		new[0] = cmdReqDgram
+	}
+
 	binary.LittleEndian.PutUint16(new[1:], r.idx)
 	binary.LittleEndian.PutUint16(new[3:], r.tag)
 	copy(new[5:], message)
 
-	dev.sendMsg(new)
+	r.sendFrame(new)
 }
 
 func (r *XRequest) xClientClosed() {
-	if r.dev == nil {
-		log.Println("failed to send client close, xdev is nil")
-		return
-	}
-
-	dev := r.dev
 	new := make([]byte, 5)
 	new[0] = cmdReqClientClosed
 	binary.LittleEndian.PutUint16(new[1:], r.idx)
 	binary.LittleEndian.PutUint16(new[3:], r.tag)
 
-	dev.sendMsg(new)
+	r.sendFrame(new)
+}
+
+func (r *XRequest) xClientFinished() {
+	new := make([]byte, 5)
+	new[0] = cmdReqClientFinished
+	binary.LittleEndian.PutUint16(new[1:], r.idx)
+	binary.LittleEndian.PutUint16(new[3:], r.tag)
+
+	r.sendFrame(new)
+}
+
+// xServerQuota report written count of current use again, the last report
+// may have been lost with the broken link
+func (r *XRequest) xServerQuota() {
+	r.mutex.Lock()
+	cw := r.cw
+	r.mutex.Unlock()
+
+	if cw != nil && cw.windowed {
+		cw.report()
+	}
 }
 
 func (r *XRequest) xClientCreate() {
-	if r.dev == nil {
-		log.Println("failed to send client create, xdev is nil")
+	if r.host != "" {
+		r.xClientHostCreate()
 		return
 	}
 
-	dev := r.dev
 	new := make([]byte, 7)
 	new[0] = cmdReqCreated
+	if r.dgram {
+		new[0] = cmdReqDgramCreated
+	}
+
+	binary.LittleEndian.PutUint16(new[1:], r.idx)
+	binary.LittleEndian.PutUint16(new[3:], r.tag)
+	binary.LittleEndian.PutUint16(new[5:], r.port)
+
+	r.sendFrame(new)
+}
+
+// xClientHostCreate create command with host, the address is encoded as socks5:
+// atyp(1) then 4 bytes ipv4, 16 bytes ipv6, or len(1) and hostname
+func (r *XRequest) xClientHostCreate() {
+	var addr []byte
+	ip := net.ParseIP(r.host)
+	if ip4 := ip.To4(); ip4 != nil {
+		addr = append([]byte{lanHostIPv4}, ip4...)
+	} else if ip != nil {
+		addr = append([]byte{lanHostIPv6}, ip.To16()...)
+	} else {
+		addr = append([]byte{lanHostName, byte(len(r.host))}, r.host...)
+	}
+
+	new := make([]byte, 7+len(addr))
+	new[0] = cmdReqHostCreated
+	if r.dgram {
+		new[0] = cmdReqHostDgramCreated
+	}
+
 	binary.LittleEndian.PutUint16(new[1:], r.idx)
 	binary.LittleEndian.PutUint16(new[3:], r.tag)
 	binary.LittleEndian.PutUint16(new[5:], r.port)
+	copy(new[7:], addr)
 
-	dev.sendMsg(new)
+	r.sendFrame(new)
 }
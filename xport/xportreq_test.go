@@ -0,0 +1,198 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"lproxy/servercfg"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// startTestDevice device without session resumption
+func startTestDevice(t *testing.T, ts *httptest.Server, query string) (*testDevice, *XDevice) {
+	uuid := fmt.Sprintf("dev-req-%d", time.Now().UnixNano())
+	td := &testDevice{t: t}
+	td.c = dialTestDevice(t, ts, "uuid="+uuid+"&"+query)
+
+	return td, waitDevice(t, uuid, func(*XDevice) bool { return true })
+}
+
+// mountPipe mount request of client on the other end of pipe, device is
+// told of the request
+func (td *testDevice) mountPipe(d *XDevice, dgram bool) (*XRequest, *pipeConn) {
+	pc, cc := newPipe(pipeAddr("client"))
+	req, err := d.mountRequest(d.uuid, "", 80, newTCPClient(pc), dgram)
+	if err != nil {
+		td.t.Fatal("mount request:", err)
+	}
+
+	go req.loopMsg()
+
+	cmd := byte(cmdReqCreated)
+	if dgram {
+		cmd = cmdReqDgramCreated
+	}
+
+	created := td.read(cmd)
+	td.idx = binary.LittleEndian.Uint16(created[1:])
+	td.tag = binary.LittleEndian.Uint16(created[3:])
+
+	return req, cc
+}
+
+// write frame of request with payload
+func (td *testDevice) write(cmd byte, payload []byte) {
+	msg := make([]byte, 5+len(payload))
+	msg[0] = cmd
+	binary.LittleEndian.PutUint16(msg[1:], td.idx)
+	binary.LittleEndian.PutUint16(msg[3:], td.tag)
+	copy(msg[5:], payload)
+
+	td.c.WriteMessage(msg)
+}
+
+// readRequest next frame of cmd, it must belong to current request
+func (td *testDevice) readRequest(cmd byte) []byte {
+	message := td.read(cmd)
+	if binary.LittleEndian.Uint16(message[1:]) != td.idx || binary.LittleEndian.Uint16(message[3:]) != td.tag {
+		td.t.Fatalf("cmd %d of unknown request", cmd)
+	}
+
+	return message[5:]
+}
+
+func waitFree(t *testing.T, req *XRequest) {
+	deadline := time.Now().Add(5 * time.Second)
+	for req.isUsed() {
+		if time.Now().After(deadline) {
+			t.Fatal("request should be freed")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestRequestQuota client data stops when quota of device is used up, and
+// goes on with what device grants
+func TestRequestQuota(t *testing.T) {
+	ts := startLWSServer()
+	defer ts.Close()
+
+	td, d := startTestDevice(t, ts, "cap=1&quota=8")
+	defer d.Kick()
+
+	req, cc := td.mountPipe(d, false)
+	defer cc.Close()
+
+	cc.Write([]byte("0123456789abcdef"))
+	if data := td.readRequest(cmdReqData); string(data) != "01234567" {
+		t.Fatalf("data within initial quota, got:%q", data)
+	}
+
+	grant := make([]byte, 4)
+	binary.LittleEndian.PutUint32(grant, 4)
+	td.write(cmdReqClientQuota, grant)
+	if data := td.readRequest(cmdReqData); string(data) != "89ab" {
+		t.Fatalf("data within granted quota, got:%q", data)
+	}
+
+	binary.LittleEndian.PutUint32(grant, 1024)
+	td.write(cmdReqClientQuota, grant)
+	if data := td.readRequest(cmdReqData); string(data) != "cdef" {
+		t.Fatalf("data after quota replenished, got:%q", data)
+	}
+
+	req.close()
+	td.readRequest(cmdReqClientClosed)
+	waitFree(t, req)
+}
+
+// TestRequestHalfClose each side finishes its write on its own, request is
+// freed after both have
+func TestRequestHalfClose(t *testing.T) {
+	ts := startLWSServer()
+	defer ts.Close()
+
+	td, d := startTestDevice(t, ts, "cap=1")
+	defer d.Kick()
+
+	req, cc := td.mountPipe(d, false)
+	defer cc.Close()
+
+	// client finished, device still writes
+	cc.Write([]byte("ping"))
+	cc.CloseWrite()
+	if data := td.readRequest(cmdReqData); string(data) != "ping" {
+		t.Fatalf("device received:%q", data)
+	}
+
+	td.readRequest(cmdReqClientFinished)
+	td.write(cmdReqData, []byte("pong"))
+	td.write(cmdReqServerFinished, nil)
+
+	got, err := ioutil.ReadAll(cc)
+	if err != nil || string(got) != "pong" {
+		t.Fatalf("client received:%q, %v", got, err)
+	}
+
+	td.readRequest(cmdReqClientClosed)
+	waitFree(t, req)
+
+	// device finished, client still writes
+	req, cc = td.mountPipe(d, false)
+	defer cc.Close()
+
+	td.write(cmdReqData, []byte("hello"))
+	td.write(cmdReqServerFinished, nil)
+	got, err = ioutil.ReadAll(cc)
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("client received:%q, %v", got, err)
+	}
+
+	cc.Write([]byte("bye"))
+	if data := td.readRequest(cmdReqData); string(data) != "bye" {
+		t.Fatalf("device received:%q", data)
+	}
+
+	cc.CloseWrite()
+	td.readRequest(cmdReqClientFinished)
+	td.readRequest(cmdReqClientClosed)
+	waitFree(t, req)
+}
+
+// TestRequestDgramIdle datagram request is closed after idle timeout, traffic
+// in either direction keeps it
+func TestRequestDgramIdle(t *testing.T) {
+	idle := servercfg.XPortDgramIdleTimeout
+	servercfg.XPortDgramIdleTimeout = 1
+	defer func() { servercfg.XPortDgramIdleTimeout = idle }()
+
+	ts := startLWSServer()
+	defer ts.Close()
+
+	td, d := startTestDevice(t, ts, "cap=1")
+	defer d.Kick()
+
+	req, cc := td.mountPipe(d, true)
+	defer cc.Close()
+
+	start := time.Now()
+	buf := make([]byte, 16)
+	for i := 0; i < 3; i++ {
+		time.Sleep(600 * time.Millisecond)
+		td.write(cmdReqDgram, []byte("keep"))
+		n, err := cc.Read(buf)
+		if err != nil || string(buf[:n]) != "keep" {
+			t.Fatalf("client received:%q, %v", buf[:n], err)
+		}
+	}
+
+	td.readRequest(cmdReqClientClosed)
+	if elapsed := time.Since(start); elapsed < 2500*time.Millisecond {
+		t.Fatal("datagram request closed while active, after:", elapsed)
+	}
+
+	waitFree(t, req)
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+)
+
+// RPC over lws link, server calls method on device and waits for result:
+// request  cmdRPCRequest(1) + id(4) + codec(1) + method length(1) + method + payload
+// response cmdRPCResponse(1) + id(4) + status(1) + codec(1) + payload
+// status 0 means success, otherwise payload is the error text.
+// Device may not call server, such requests are answered with rpcStatusNoMethod.
+// Device must negotiate xportVersionRPC at least.
+
+const (
+	rpcCodecJSON  = 0
+	rpcCodecProto = 1
+
+	rpcStatusOK       = 0
+	rpcStatusError    = 1
+	rpcStatusNoMethod = 2
+
+	rpcDefaultTimeout = 30 * time.Second
+)
+
+var (
+	errRPCClosed = errors.New("rpc: device gone")
+
+	// ErrRPCUnsupported device does not negotiate xportVersionRPC
+	ErrRPCUnsupported = errors.New("rpc: device does not support rpc")
+)
+
+// RPCError error returned by device
+type RPCError struct {
+	Status int
+	Text   string
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc: device error, status:%d, %s", e.Status, e.Text)
+}
+
+type rpcResponse struct {
+	status  byte
+	codec   byte
+	payload []byte
+}
+
+type rpcCall struct {
+	ch chan *rpcResponse
+}
+
+// Call invoke method on device and decode result into reply, args and reply
+// are encoded by protobuf if they are proto.Message, otherwise JSON; reply may be nil.
+// It waits for rpcDefaultTimeout if ctx has no deadline.
+func (d *XDevice) Call(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	if d.version < xportVersionRPC {
+		return ErrRPCUnsupported
+	}
+
+	if len(method) == 0 || len(method) > 255 {
+		return fmt.Errorf("rpc: invalid method name:%s", method)
+	}
+
+	codec := byte(rpcCodecJSON)
+	var payload []byte
+	var err error
+	if pm, ok := args.(proto.Message); ok {
+		codec = rpcCodecProto
+		payload, err = proto.Marshal(pm)
+	} else if args != nil {
+		payload, err = json.Marshal(args)
+	}
+
+	if err != nil {
+		return fmt.Errorf("rpc: encode args failed:%v", err)
+	}
+
+	// extended length link allows larger message
+	c := d.getConn()
+	if c == nil {
+		return fmt.Errorf("rpc: device has no lws link")
+	}
+
+	if 7+len(method)+len(payload) > c.MaxMessageLength() {
+		return fmt.Errorf("rpc: args too large:%d", len(payload))
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rpcDefaultTimeout)
+		defer cancel()
+	}
+
+	id, call := d.newRPCCall()
+	if call == nil {
+		return errRPCClosed
+	}
+
+	defer d.removeRPCCall(id)
+
+	msg := make([]byte, 7+len(method)+len(payload))
+	msg[0] = cmdRPCRequest
+	binary.LittleEndian.PutUint32(msg[1:], id)
+	msg[5] = codec
+	msg[6] = byte(len(method))
+	copy(msg[7:], method)
+	copy(msg[7+len(method):], payload)
+
+	err = d.writeMsg(msg)
+	if err != nil {
+		return fmt.Errorf("rpc: send request failed:%v", err)
+	}
+
+	var rsp *rpcResponse
+	select {
+	case rsp = <-call.ch:
+	case <-ctx.Done():
+		return fmt.Errorf("rpc: call %s failed:%v", method, ctx.Err())
+	}
+
+	if rsp == nil {
+		return errRPCClosed
+	}
+
+	if rsp.status != rpcStatusOK {
+		return &RPCError{Status: int(rsp.status), Text: string(rsp.payload)}
+	}
+
+	if reply == nil {
+		return nil
+	}
+
+	if pm, ok := reply.(proto.Message); ok && rsp.codec == rpcCodecProto {
+		err = proto.Unmarshal(rsp.payload, pm)
+	} else {
+		err = json.Unmarshal(rsp.payload, reply)
+	}
+
+	if err != nil {
+		return fmt.Errorf("rpc: decode reply failed:%v", err)
+	}
+
+	return nil
+}
+
+func (d *XDevice) newRPCCall() (uint32, *rpcCall) {
+	d.rpcMutex.Lock()
+	defer d.rpcMutex.Unlock()
+
+	if d.rpcClosed {
+		return 0, nil
+	}
+
+	if d.rpcCalls == nil {
+		d.rpcCalls = make(map[uint32]*rpcCall)
+	}
+
+	d.rpcSeq++
+	call := &rpcCall{ch: make(chan *rpcResponse, 1)}
+	d.rpcCalls[d.rpcSeq] = call
+
+	return d.rpcSeq, call
+}
+
+func (d *XDevice) removeRPCCall(id uint32) {
+	d.rpcMutex.Lock()
+	delete(d.rpcCalls, id)
+	d.rpcMutex.Unlock()
+}
+
+// failRPCCalls wake up all waiting calls, device is gone
+func (d *XDevice) failRPCCalls() {
+	d.rpcMutex.Lock()
+	defer d.rpcMutex.Unlock()
+
+	d.rpcClosed = true
+	for id, call := range d.rpcCalls {
+		call.ch <- nil
+		delete(d.rpcCalls, id)
+	}
+}
+
+func (d *XDevice) onRPCResponse(message []byte) {
+	if len(message) < 7 {
+		log.Errorln("rpc response message len should >= 7")
+		return
+	}
+
+	id := binary.LittleEndian.Uint32(message[1:])
+	rsp := &rpcResponse{
+		status:  message[5],
+		codec:   message[6],
+		payload: message[7:],
+	}
+
+	d.rpcMutex.Lock()
+	call, ok := d.rpcCalls[id]
+	delete(d.rpcCalls, id)
+	d.rpcMutex.Unlock()
+
+	if !ok {
+		log.Printf("rpc response for unknown call:%d, uuid:%s", id, d.uuid)
+		return
+	}
+
+	call.ch <- rsp
+}
+
+// onRPCRequest server exports no method to device yet
+func (d *XDevice) onRPCRequest(message []byte) {
+	if len(message) < 7 {
+		log.Errorln("rpc request message len should >= 7")
+		return
+	}
+
+	text := "no such method"
+	msg := make([]byte, 7+len(text))
+	msg[0] = cmdRPCResponse
+	copy(msg[1:5], message[1:5])
+	msg[5] = rpcStatusNoMethod
+	msg[6] = rpcCodecJSON
+	copy(msg[7:], text)
+
+	d.sendMsg(msg)
+}
+
+// Call invoke method on online device by uuid, see XDevice.Call
+func (reg *DeviceRegistry) Call(ctx context.Context, uuid string, method string, args interface{}, reply interface{}) error {
+	d := reg.Get(uuid)
+	if d == nil {
+		return fmt.Errorf("rpc: no dev found for uuid:%s", uuid)
+	}
+
+	return d.Call(ctx, method, args, reply)
+}
@@ -0,0 +1,366 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Writes are decoupled from readers in both directions:
+// frames to device are queued by writeScheduler and written by one goroutine
+// per device, control frames first, then request frames round-robin, so a
+// busy request can't starve others; data to client is queued by clientWriter
+// and written by one goroutine per request, so a slow client never blocks
+// the device read loop.
+//
+// Backpressure to device is per request: device that negotiated
+// xportVersionServerQuota sends at most reqServerWindow bytes of a stream
+// request beyond what server has written to client, server reports the
+// written count by cmdReqServerQuota(idx, tag, written(4)) as client drains,
+// the count is absolute so a lost report is made up by the next one. Device
+// without it can't be held back, its request is closed when client queue
+// overflows.
+
+const (
+	// block request from sending more when so many bytes queued to device
+	maxRequestQueueBytes = 128 * 1024
+	// close request when so many bytes queued to a client that can't keep up,
+	// datagrams are dropped instead
+	maxClientQueueBytes = 1024 * 1024
+	// bytes device may send beyond written count, since xportVersionServerQuota
+	reqServerWindow = 256 * 1024
+)
+
+var (
+	errClientQueueFull = errors.New("XRequest client queue full")
+)
+
+// writeScheduler frames queue of device
+type writeScheduler struct {
+	d       *XDevice
+	cond    *sync.Cond
+	control [][]byte
+	// requests that have frames queued, in round-robin order
+	ready   []*XRequest
+	stopped bool
+}
+
+func newWriteScheduler(d *XDevice) *writeScheduler {
+	return &writeScheduler{
+		d:    d,
+		cond: sync.NewCond(&sync.Mutex{}),
+	}
+}
+
+// pushControl queue a frame that is not bound to any request
+func (s *writeScheduler) pushControl(msg []byte) {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+
+	if s.stopped {
+		return
+	}
+
+	s.control = append(s.control, msg)
+	s.cond.Broadcast()
+}
+
+// push queue a request frame, never block, see waitSpace
+func (s *writeScheduler) push(r *XRequest, msg []byte) {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+
+	if s.stopped {
+		return
+	}
+
+	r.wq = append(r.wq, msg)
+	r.wqBytes = r.wqBytes + len(msg)
+	if !r.wqReady {
+		r.wqReady = true
+		s.ready = append(s.ready, r)
+	}
+
+	s.cond.Broadcast()
+}
+
+// waitSpace block until request queue has space, writer always drains
+// the queues, so it does not wait forever
+func (s *writeScheduler) waitSpace(r *XRequest) {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+
+	for r.wqBytes >= maxRequestQueueBytes && !s.stopped {
+		s.cond.Wait()
+	}
+}
+
+// purge drop all queued frames, session resumption replays request frames
+func (s *writeScheduler) purge() {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+
+	s.control = nil
+	for _, r := range s.ready {
+		r.wq = nil
+		r.wqBytes = 0
+		r.wqReady = false
+	}
+
+	s.ready = nil
+	s.cond.Broadcast()
+}
+
+func (s *writeScheduler) stop() {
+	s.cond.L.Lock()
+	s.stopped = true
+	s.cond.Broadcast()
+	s.cond.L.Unlock()
+
+	s.purge()
+}
+
+// next wait for the next frame, nil if stopped
+func (s *writeScheduler) next() []byte {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+
+	for len(s.control) == 0 && len(s.ready) == 0 && !s.stopped {
+		s.cond.Wait()
+	}
+
+	if s.stopped {
+		return nil
+	}
+
+	if len(s.control) > 0 {
+		msg := s.control[0]
+		s.control = s.control[1:]
+		return msg
+	}
+
+	r := s.ready[0]
+	s.ready = s.ready[1:]
+
+	msg := r.wq[0]
+	r.wq = r.wq[1:]
+	r.wqBytes = r.wqBytes - len(msg)
+	if len(r.wq) > 0 {
+		// to the tail, let other requests go first
+		s.ready = append(s.ready, r)
+	} else {
+		r.wqReady = false
+	}
+
+	s.cond.Broadcast()
+	return msg
+}
+
+func (s *writeScheduler) loop() {
+	for {
+		msg := s.next()
+		if msg == nil {
+			return
+		}
+
+		c := s.d.getConn()
+		if c == nil {
+			// link broken, resumable session replays request frames later
+			continue
+		}
+
+		err := c.WriteMessage(msg)
+		if err != nil {
+			log.Println("XDevice write failed:", err)
+			s.d.close()
+		}
+	}
+}
+
+const (
+	clientOpData = iota
+	clientOpCloseWrite
+	clientOpClose
+)
+
+type clientOp struct {
+	op   int
+	data []byte
+}
+
+// clientWriter data queue of a request to its client, it serves one use
+// of the request, identified by tag
+type clientWriter struct {
+	r         *XRequest
+	conn      xclient
+	tag       uint16
+	dgram     bool
+	cond      *sync.Cond
+	queue     []*clientOp
+	bytes     int
+	finishing bool
+	stopped   bool
+
+	// device is held back by reqServerWindow, written is the data bytes
+	// written to client, reported is the count last sent to device
+	windowed bool
+	written  uint32
+	reported uint32
+}
+
+func newClientWriter(r *XRequest, conn xclient, tag uint16, dgram bool) *clientWriter {
+	return &clientWriter{
+		r:        r,
+		conn:     conn,
+		tag:      tag,
+		dgram:    dgram,
+		cond:     sync.NewCond(&sync.Mutex{}),
+		windowed: r.dev.version >= xportVersionServerQuota && !dgram,
+	}
+}
+
+// push queue an op, never block, fail with errClientQueueFull if
+// maxClientQueueBytes queued for stream, datagram is dropped instead
+func (w *clientWriter) push(op int, data []byte) error {
+	w.cond.L.Lock()
+	defer w.cond.L.Unlock()
+
+	if op == clientOpCloseWrite {
+		if w.finishing {
+			return nil
+		}
+
+		w.finishing = true
+	}
+
+	if w.stopped {
+		return fmt.Errorf("XRequest client writer stopped")
+	}
+
+	if len(data) > 0 && w.bytes >= maxClientQueueBytes {
+		if w.dgram {
+			log.Printf("xrequest client queue full, drop datagram, idx:%d", w.r.idx)
+			return nil
+		}
+
+		// client is slow, and device does not hold back
+		return errClientQueueFull
+	}
+
+	w.queue = append(w.queue, &clientOp{op: op, data: data})
+	w.bytes = w.bytes + len(data)
+	w.cond.Broadcast()
+
+	return nil
+}
+
+func (w *clientWriter) stop() {
+	w.cond.L.Lock()
+	w.stopped = true
+	w.queue = nil
+	w.bytes = 0
+	w.cond.Broadcast()
+	w.cond.L.Unlock()
+}
+
+func (w *clientWriter) next() *clientOp {
+	w.cond.L.Lock()
+	defer w.cond.L.Unlock()
+
+	for len(w.queue) == 0 && !w.stopped {
+		w.cond.Wait()
+	}
+
+	if w.stopped {
+		return nil
+	}
+
+	op := w.queue[0]
+	w.queue = w.queue[1:]
+	w.bytes = w.bytes - len(op.data)
+	w.cond.Broadcast()
+
+	return op
+}
+
+func (w *clientWriter) loop() {
+	// pusher must not wait for a writer that has gone
+	defer w.stop()
+
+	r := w.r
+	for {
+		op := w.next()
+		if op == nil {
+			return
+		}
+
+		switch op.op {
+		case clientOpData:
+			r.waitSend(len(op.data))
+			err := w.conn.writeMessage(op.data)
+			if err != nil {
+				log.Println("xrequest client write failed:", err)
+				r.closeTag(w.tag)
+				return
+			}
+
+			// counted once written, dropped or queued data is not sent
+			r.onSent(len(op.data))
+			w.onWritten(len(op.data))
+		case clientOpCloseWrite:
+			err := w.conn.closeWrite()
+			if err != nil {
+				log.Println("xrequest client closeWrite failed:", err)
+				r.closeTag(w.tag)
+				return
+			}
+
+			// set after all data written, client loop closes request
+			// when it sees both sides finished
+			if r.setServerFinished(w.tag) {
+				// both sides have finished
+				r.closeTag(w.tag)
+				return
+			}
+		case clientOpClose:
+			r.closeTag(w.tag)
+			return
+		}
+	}
+}
+
+// onWritten report written count to device when a quarter of window drained,
+// device that waits for window always gets it, as it has sent a full window
+func (w *clientWriter) onWritten(n int) {
+	if !w.windowed {
+		return
+	}
+
+	w.cond.L.Lock()
+	w.written = w.written + uint32(n)
+	report := w.written-w.reported >= reqServerWindow/4
+	w.cond.L.Unlock()
+
+	if report {
+		w.report()
+	}
+}
+
+// report send written count to device
+func (w *clientWriter) report() {
+	w.cond.L.Lock()
+	w.reported = w.written
+	written := w.written
+	w.cond.L.Unlock()
+
+	new := make([]byte, 9)
+	new[0] = cmdReqServerQuota
+	binary.LittleEndian.PutUint16(new[1:], w.r.idx)
+	binary.LittleEndian.PutUint16(new[3:], w.tag)
+	binary.LittleEndian.PutUint32(new[5:], written)
+
+	w.r.dev.sendMsg(new)
+}
@@ -0,0 +1,364 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"lproxy/servercfg"
+	"lproxy/xport/lws"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Session resumption:
+// device that connects with 'resume=1' gets a session id by cmdSessionInfo,
+// every request frame (cmd with idx and tag) is numbered implicitly from 1 in
+// each direction, except cmdReqAck and cmdReqServerQuota, and receiver
+// acknowledges the count it has received by cmdReqAck. When lws link broken,
+// requests are kept for XPortResumeGrace, device reconnects with 'session=id',
+// then server sends cmdSessionInfo, and cmdReqAck and cmdReqServerQuota for
+// every live request, device replays the frames after the acked count and
+// acks every request it holds, server replays on receiving the ack.
+// Requests that device does not ack are gone on the other side.
+
+const (
+	// send ack after received so many frames
+	reqAckEvery = 16
+	// or after so long if less received
+	reqAckInterval = time.Second
+	// block sender when so many bytes waiting for ack
+	maxReplayBytes = 256 * 1024
+)
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Panicln("newSessionID failed:", err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+func (d *XDevice) sendSessionInfo() {
+	msg := make([]byte, 1+len(d.sessionID))
+	msg[0] = cmdSessionInfo
+	copy(msg[1:], d.sessionID)
+
+	d.sendMsg(msg)
+}
+
+func resumeGrace() time.Duration {
+	return time.Duration(servercfg.XPortResumeGrace) * time.Second
+}
+
+// detach keep the session after lws link broken, return false if the session
+// is not resumable or has been shut down
+func (d *XDevice) detach() bool {
+	d.connMutex.Lock()
+	if !d.resumable || d.shut {
+		d.connMutex.Unlock()
+		return false
+	}
+
+	d.conn = nil
+	d.detached = true
+	d.graceTimer = time.AfterFunc(resumeGrace(), d.expire)
+	d.connMutex.Unlock()
+
+	// frames queued for the broken link are replayed after resumed
+	d.sched.purge()
+
+	// frames are buffered until device acks after resumed
+	for _, r := range d.allRequests() {
+		if r.isUsed() {
+			r.pauseReplay()
+		}
+	}
+
+	return true
+}
+
+// expire device does not resume in grace window
+func (d *XDevice) expire() {
+	d.connMutex.Lock()
+	if !d.detached {
+		d.connMutex.Unlock()
+		return
+	}
+
+	d.detached = false
+	d.shut = true
+	d.graceTimer = nil
+	d.connMutex.Unlock()
+
+	log.Printf("XDevice resume grace expired, uuid:%s", d.uuid)
+	d.end()
+}
+
+// shutdown end the session, it can't be resumed any more
+func (d *XDevice) shutdown() {
+	d.connMutex.Lock()
+	d.shut = true
+	detached := d.detached
+	d.detached = false
+	if d.graceTimer != nil {
+		d.graceTimer.Stop()
+		d.graceTimer = nil
+	}
+	d.connMutex.Unlock()
+
+	if detached {
+		// no loopMsg running, end it here
+		d.end()
+	} else {
+		d.close()
+	}
+}
+
+// resume attach new lws link to the session
+func (d *XDevice) resume(session string, c *lws.Conn, version int) bool {
+	// frames kept for replay are sized and encoded for the old link mode
+	if !d.resumable || d.sessionID != session || d.extended != c.Extended() ||
+		d.version != version {
+		return false
+	}
+
+	// the old link may be half-open, close it and wait its loop to detach
+	d.close()
+	d.wg.Wait()
+
+	d.connMutex.Lock()
+	if d.shut || !d.detached {
+		d.connMutex.Unlock()
+		return false
+	}
+
+	d.detached = false
+	if d.graceTimer != nil {
+		d.graceTimer.Stop()
+		d.graceTimer = nil
+	}
+
+	d.conn = c
+	d.peerAddr = c.RemoteAddr().String()
+	d.linkGen++
+	gen := d.linkGen
+	closes := d.pausedCloses
+	d.pausedCloses = nil
+	d.connMutex.Unlock()
+
+	d.sendSessionInfo()
+	for _, r := range d.allRequests() {
+		if r.isUsed() {
+			r.xAck()
+			r.xServerQuota()
+		}
+	}
+
+	for _, id := range closes {
+		d.xRequestClosed(uint16(id>>16), uint16(id))
+	}
+
+	time.AfterFunc(resumeGrace(), func() {
+		d.expireResuming(gen)
+	})
+
+	return true
+}
+
+// expireResuming close requests that device does not ack after resumed
+func (d *XDevice) expireResuming(gen int) {
+	d.connMutex.Lock()
+	current := d.linkGen == gen && !d.detached
+	d.connMutex.Unlock()
+
+	if !current {
+		return
+	}
+
+	for _, r := range d.allRequests() {
+		tag, used := r.currentTag()
+		if used && r.isPaused() {
+			log.Printf("xrequest not acked after resume, idx:%d, tag:%d", r.idx, tag)
+			r.closeTag(tag)
+		}
+	}
+}
+
+// ackLoop ack frames that are fewer than reqAckEvery periodically,
+// until the link closed
+func (d *XDevice) ackLoop(linkCh chan struct{}) {
+	ticker := time.NewTicker(reqAckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-linkCh:
+			return
+		case <-ticker.C:
+			d.flushAcks()
+		}
+	}
+}
+
+// onPausedFree the close of request has not reached device, which still
+// holds the request of tag, tell it now or after resumed
+func (d *XDevice) onPausedFree(idx uint16, tag uint16) {
+	d.connMutex.Lock()
+	if d.shut {
+		d.connMutex.Unlock()
+		return
+	}
+
+	if d.detached {
+		d.pausedCloses = append(d.pausedCloses, uint32(idx)<<16|uint32(tag))
+		d.connMutex.Unlock()
+		return
+	}
+	d.connMutex.Unlock()
+
+	d.xRequestClosed(idx, tag)
+}
+
+// xRequestClosed cmdReqClientClosed of a request that has been freed
+func (d *XDevice) xRequestClosed(idx uint16, tag uint16) {
+	new := make([]byte, 5)
+	new[0] = cmdReqClientClosed
+	binary.LittleEndian.PutUint16(new[1:], idx)
+	binary.LittleEndian.PutUint16(new[3:], tag)
+
+	d.sendMsg(new)
+}
+
+// flushAcks ack all received frames
+func (d *XDevice) flushAcks() {
+	if !d.resumable {
+		return
+	}
+
+	for _, r := range d.allRequests() {
+		if !r.isUsed() {
+			continue
+		}
+
+		r.replayCond.L.Lock()
+		pending := r.recvSeq != r.ackedRecv
+		r.replayCond.L.Unlock()
+
+		if pending {
+			r.xAck()
+		}
+	}
+}
+
+func (r *XRequest) resetReplay() {
+	r.replayCond.L.Lock()
+	r.frames = nil
+	r.replayBytes = 0
+	r.sentSeq = 0
+	r.recvSeq = 0
+	r.ackedRecv = 0
+	r.paused = false
+	r.replayCond.Broadcast()
+	r.replayCond.L.Unlock()
+}
+
+func (r *XRequest) pauseReplay() {
+	r.replayCond.L.Lock()
+	r.paused = true
+	r.replayCond.L.Unlock()
+}
+
+func (r *XRequest) isPaused() bool {
+	r.replayCond.L.Lock()
+	defer r.replayCond.L.Unlock()
+
+	return r.paused
+}
+
+// sendFrame send request frame to device, keep it for replay if session is resumable
+func (r *XRequest) sendFrame(msg []byte) {
+	dev := r.dev
+	if !dev.resumable {
+		dev.sched.push(r, msg)
+		return
+	}
+
+	r.replayCond.L.Lock()
+	defer r.replayCond.L.Unlock()
+
+	for r.replayBytes >= maxReplayBytes && r.client() != nil {
+		r.replayCond.Wait()
+	}
+
+	r.frames = append(r.frames, msg)
+	r.replayBytes = r.replayBytes + len(msg)
+	r.sentSeq++
+
+	if !r.paused {
+		dev.sched.push(r, msg)
+	}
+}
+
+// onAck device has received seq frames, drop them, and replay the others if paused
+func (r *XRequest) onAck(seq uint32) {
+	r.replayCond.L.Lock()
+	defer r.replayCond.L.Unlock()
+
+	first := r.sentSeq - uint32(len(r.frames)) + 1
+	if seq >= first {
+		drop := int(seq - first + 1)
+		if drop > len(r.frames) {
+			drop = len(r.frames)
+		}
+
+		for _, f := range r.frames[:drop] {
+			r.replayBytes = r.replayBytes - len(f)
+		}
+
+		r.frames = r.frames[drop:]
+	}
+
+	if r.paused {
+		r.paused = false
+		log.Printf("xrequest resumed, idx:%d, tag:%d, replay:%d", r.idx, r.tag, len(r.frames))
+		for _, f := range r.frames {
+			r.dev.sched.push(r, f)
+		}
+	}
+
+	r.replayCond.Broadcast()
+}
+
+func (r *XRequest) onRecvFrame() {
+	r.replayCond.L.Lock()
+	r.recvSeq++
+	needAck := r.recvSeq-r.ackedRecv >= reqAckEvery
+	r.replayCond.L.Unlock()
+
+	if needAck {
+		r.xAck()
+	}
+}
+
+// xAck tell device how many frames received
+func (r *XRequest) xAck() {
+	r.mutex.Lock()
+	tag := r.tag
+	r.mutex.Unlock()
+
+	r.replayCond.L.Lock()
+	seq := r.recvSeq
+	r.ackedRecv = seq
+	r.replayCond.L.Unlock()
+
+	new := make([]byte, 9)
+	new[0] = cmdReqAck
+	binary.LittleEndian.PutUint16(new[1:], r.idx)
+	binary.LittleEndian.PutUint16(new[3:], tag)
+	binary.LittleEndian.PutUint32(new[5:], seq)
+
+	r.dev.sendMsg(new)
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"lproxy/xport/lws"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDevice device side of xport speaking session resumption, frames of one
+// request are logged for replay, see xportsession.go
+type testDevice struct {
+	t       *testing.T
+	c       *lws.Conn
+	session string
+
+	idx uint16
+	tag uint16
+	// frames sent, and count of request frames received
+	sent     [][]byte
+	recvSeq  uint32
+	received []byte
+}
+
+func startLWSServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := newTestContext(w, r)
+		ctx.UUID = ctx.Query.Get("uuid")
+		xportServeLWS(ctx)
+	}))
+}
+
+func dialTestDevice(t *testing.T, ts *httptest.Server, query string) *lws.Conn {
+	u := "ws" + strings.TrimPrefix(ts.URL, "http") + "/lws?" + query
+	d := &lws.Dialer{HandshakeTimeout: 5 * time.Second}
+	c, _, err := d.DialContext(context.Background(), u, nil)
+	if err != nil {
+		t.Fatal("dial lws:", err)
+	}
+
+	return c
+}
+
+// read next message of cmd, others that are not bound to the request are skipped
+func (td *testDevice) read(cmd byte) []byte {
+	td.c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		message, err := td.c.ReadMessage()
+		if err != nil {
+			td.t.Fatalf("device read cmd %d: %v", cmd, err)
+		}
+
+		if message[0] == cmd {
+			return message
+		}
+
+		if message[0] == cmdPing || message[0] == cmdReqAck || message[0] == cmdReqServerQuota {
+			continue
+		}
+
+		td.t.Fatalf("device read cmd %d, got:%d", cmd, message[0])
+	}
+}
+
+// recv count and keep data of a request frame, drop it if lost
+func (td *testDevice) recv(message []byte, lost bool) {
+	if lost {
+		return
+	}
+
+	td.recvSeq++
+	if message[0] == cmdReqData {
+		td.received = append(td.received, message[5:]...)
+	}
+}
+
+// send log a data frame for replay, write it unless lost
+func (td *testDevice) send(data string, lost bool) {
+	msg := make([]byte, 5+len(data))
+	msg[0] = cmdReqData
+	binary.LittleEndian.PutUint16(msg[1:], td.idx)
+	binary.LittleEndian.PutUint16(msg[3:], td.tag)
+	copy(msg[5:], data)
+
+	td.sent = append(td.sent, msg)
+	if !lost {
+		td.c.WriteMessage(msg)
+	}
+}
+
+// resume reconnect with session, replay what server has not received and
+// ack what device has received
+func (td *testDevice) resume(ts *httptest.Server, uuid string, acked bool) {
+	td.c = dialTestDevice(td.t, ts, "uuid="+uuid+"&cap=2&resume=1&session="+td.session)
+	if string(td.read(cmdSessionInfo)[1:]) != td.session {
+		td.t.Fatal("session should be resumed")
+	}
+
+	if !acked {
+		return
+	}
+
+	ack := td.read(cmdReqAck)
+	if binary.LittleEndian.Uint16(ack[1:]) != td.idx || binary.LittleEndian.Uint16(ack[3:]) != td.tag {
+		td.t.Fatal("ack of unknown request")
+	}
+
+	for _, msg := range td.sent[binary.LittleEndian.Uint32(ack[5:]):] {
+		td.c.WriteMessage(msg)
+	}
+
+	new := make([]byte, 9)
+	new[0] = cmdReqAck
+	binary.LittleEndian.PutUint16(new[1:], td.idx)
+	binary.LittleEndian.PutUint16(new[3:], td.tag)
+	binary.LittleEndian.PutUint32(new[5:], td.recvSeq)
+	td.c.WriteMessage(new)
+}
+
+func waitDevice(t *testing.T, uuid string, cond func(d *XDevice) bool) *XDevice {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d := devices.Get(uuid)
+		if d != nil && cond(d) {
+			return d
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("device not in expected state")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestSessionResume link dropped in the middle of both directions, frames
+// lost on the link are replayed after resumed, nothing lost or duplicated
+func TestSessionResume(t *testing.T) {
+	ts := startLWSServer()
+	defer ts.Close()
+
+	uuid := fmt.Sprintf("dev-resume-%d", time.Now().UnixNano())
+	td := &testDevice{t: t}
+	td.c = dialTestDevice(t, ts, "uuid="+uuid+"&cap=2&resume=1")
+	td.session = string(td.read(cmdSessionInfo)[1:])
+
+	d := waitDevice(t, uuid, func(*XDevice) bool { return true })
+	cc, sc := net.Pipe()
+	defer cc.Close()
+
+	req, err := d.mountRequest(uuid, "", 80, newTCPClient(sc), false)
+	if err != nil {
+		t.Fatal("mount request:", err)
+	}
+
+	go req.loopMsg()
+
+	created := td.read(cmdReqCreated)
+	td.idx = binary.LittleEndian.Uint16(created[1:])
+	td.tag = binary.LittleEndian.Uint16(created[3:])
+	td.recv(created, false)
+
+	var mutex sync.Mutex
+	var got []byte
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := cc.Read(buf)
+			mutex.Lock()
+			got = append(got, buf[:n]...)
+			mutex.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	cc.Write([]byte("hello-1,"))
+	td.recv(td.read(cmdReqData), false)
+	for i := 0; i < 10; i++ {
+		td.send(fmt.Sprintf("a%d,", i), false)
+	}
+
+	// the last frame of each direction is lost with the link
+	cc.Write([]byte("hello-2,"))
+	td.recv(td.read(cmdReqData), true)
+	td.send("b0,", true)
+	td.c.Close()
+
+	waitDevice(t, uuid, (*XDevice).Detached)
+	cc.Write([]byte("hello-3,"))
+
+	td.resume(ts, uuid, true)
+	for len(td.received) < len("hello-1,hello-2,hello-3,") {
+		td.recv(td.read(cmdReqData), false)
+	}
+
+	if string(td.received) != "hello-1,hello-2,hello-3," {
+		t.Fatalf("device received:%q", td.received)
+	}
+
+	td.send("b1,", false)
+	want := "a0,a1,a2,a3,a4,a5,a6,a7,a8,a9,b0,b1,"
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mutex.Lock()
+		s := string(got)
+		mutex.Unlock()
+
+		if s == want {
+			break
+		}
+
+		if len(s) > len(want) || time.Now().After(deadline) {
+			t.Fatalf("client received:%q, want:%q", s, want)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// fewer than reqAckEvery frames are acked by timer, read fails if not
+	for {
+		ack := td.read(cmdReqAck)
+		if binary.LittleEndian.Uint32(ack[5:]) == uint32(len(td.sent)) {
+			break
+		}
+	}
+
+	// client gone while detached, device is told after resumed
+	td.c.Close()
+	waitDevice(t, uuid, (*XDevice).Detached)
+	sc.Close()
+	for req.isUsed() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	td.resume(ts, uuid, false)
+	closed := td.read(cmdReqClientClosed)
+	if binary.LittleEndian.Uint16(closed[1:]) != td.idx || binary.LittleEndian.Uint16(closed[3:]) != td.tag {
+		t.Fatal("close of unknown request")
+	}
+
+	d.Kick()
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"errors"
+)
+
+var (
+	errNoFreeSlot         = errors.New("no free request slot")
+	errLANHostUnsupported = errors.New("device does not support LAN host")
+	errDeviceOffline      = errors.New("device offline")
+)
+
+// request slots are allocated lazily up to the cap that device provided,
+// released slots are reused in FIFO order, so a slot's tag changes slowly
+// and a stale frame is unlikely to match a reused slot after tag wraparound
+
+// allocSlot get a free request slot, nil if all slots are in use
+func (d *XDevice) allocSlot() *XRequest {
+	d.slotMutex.Lock()
+	defer d.slotMutex.Unlock()
+
+	if len(d.freeSlots) > 0 {
+		idx := d.freeSlots[0]
+		d.freeSlots = d.freeSlots[1:]
+		return d.requests[idx]
+	}
+
+	if len(d.requests) < d.cap {
+		r := newXRequest(d, uint16(len(d.requests)))
+		d.requests = append(d.requests, r)
+		return r
+	}
+
+	return nil
+}
+
+// releaseSlot put request slot back to free list
+func (d *XDevice) releaseSlot(idx uint16) {
+	d.slotMutex.Lock()
+	defer d.slotMutex.Unlock()
+
+	d.freeSlots = append(d.freeSlots, idx)
+}
+
+// slot get request slot by idx, nil if not allocated
+func (d *XDevice) slot(idx uint16) *XRequest {
+	d.slotMutex.Lock()
+	defer d.slotMutex.Unlock()
+
+	if int(idx) >= len(d.requests) {
+		return nil
+	}
+
+	return d.requests[idx]
+}
+
+// allRequests snapshot of allocated request slots
+func (d *XDevice) allRequests() []*XRequest {
+	d.slotMutex.Lock()
+	defer d.slotMutex.Unlock()
+
+	list := make([]*XRequest, len(d.requests))
+	copy(list, d.requests)
+	return list
+}
+
+// SlotUsage in used slots count and the cap of device
+func (d *XDevice) SlotUsage() (int, int) {
+	d.slotMutex.Lock()
+	defer d.slotMutex.Unlock()
+
+	return len(d.requests) - len(d.freeSlots), d.cap
+}
+
+// nextTag tag never be zero, so zero can't match any request
+func nextTag(tag uint16) uint16 {
+	tag++
+	if tag == 0 {
+		tag = 1
+	}
+
+	return tag
+}
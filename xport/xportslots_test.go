@@ -0,0 +1,73 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestNextTag(t *testing.T) {
+	cases := map[uint16]uint16{0: 1, 1: 2, 0xfffe: 0xffff, 0xffff: 1}
+	for tag, want := range cases {
+		if got := nextTag(tag); got != want {
+			t.Errorf("next of tag %d, got:%d, want:%d", tag, got, want)
+		}
+	}
+}
+
+// TestSlotExhaustion no request can be mounted beyond cap of device, a freed
+// slot is reused, and its tag skips zero when wrapped around
+func TestSlotExhaustion(t *testing.T) {
+	ts := startLWSServer()
+	defer ts.Close()
+
+	td, d := startTestDevice(t, ts, "cap=2")
+	defer d.Kick()
+
+	req1, cc1 := td.mountPipe(d, false)
+	defer cc1.Close()
+
+	req2, cc2 := td.mountPipe(d, false)
+	defer cc2.Close()
+
+	if used, cap := d.SlotUsage(); used != 2 || cap != 2 {
+		t.Fatalf("slot usage:%d/%d", used, cap)
+	}
+
+	pc, _ := newPipe(pipeAddr("client"))
+	if _, err := d.mountRequest(d.uuid, "", 80, newTCPClient(pc), false); err != errNoFreeSlot {
+		t.Fatal("mount beyond cap should fail, got:", err)
+	}
+
+	if used, _ := d.SlotUsage(); used != 2 {
+		t.Fatal("failed mount should not hold a slot, used:", used)
+	}
+
+	// the slot freed first is reused first
+	req2.close()
+	td.read(cmdReqClientClosed)
+	waitFree(t, req2)
+	req1.close()
+	td.read(cmdReqClientClosed)
+	waitFree(t, req1)
+
+	req1.mutex.Lock()
+	tag := req1.tag
+	req1.mutex.Unlock()
+
+	req2.mutex.Lock()
+	req2.tag = 0xffff
+	req2.mutex.Unlock()
+
+	req, cc := td.mountPipe(d, false)
+	defer cc.Close()
+
+	if req != req2 || td.tag != 1 {
+		t.Fatalf("request idx:%d, tag:%d, want idx:%d, tag:1", td.idx, td.tag, req2.idx)
+	}
+
+	req, cc = td.mountPipe(d, false)
+	defer cc.Close()
+
+	if req != req1 || td.tag != nextTag(tag) {
+		t.Fatalf("request idx:%d, tag:%d, want idx:%d, tag:%d", td.idx, td.tag, req1.idx, nextTag(tag))
+	}
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"lproxy/server"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// socks5, rfc1928, with username/password authentication of rfc1929
+
+const (
+	socksVersion = 5
+
+	socksAuthPassword     = 2
+	socksAuthNoAcceptable = 0xff
+
+	socksPasswordAuthVersion   = 1
+	socksPasswordAuthSucceeded = 0
+	socksPasswordAuthFailed    = 1
+
+	socksCmdConnect = 1
+
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+
+	socksRepSucceeded        = 0
+	socksRepGeneralFailure   = 1
+	socksRepNotAllowed       = 2
+	socksRepHostUnreachable  = 4
+	socksRepCmdNotSupported  = 7
+	socksRepAtypNotSupported = 8
+)
+
+func serveSocksConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(proxyHandshakeTimeout))
+	t, err := socksHandshake(conn)
+	if err != nil {
+		log.Printf("socks5 handshake with %s failed:%v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	// success is replied through request, so data from device can't go ahead
+	// of it, device dials the destination after created, failure closes the conn
+	conn.SetDeadline(time.Time{})
+	xreq, err := t.mount(conn, socksReplyMsg(socksRepSucceeded))
+	if err != nil {
+		log.Println("failed to mount request into xdev:", err)
+		socksReply(conn, socksRepGeneralFailure)
+		conn.Close()
+		return
+	}
+
+	log.Printf("socks5 accept from:%s, account:%s, uuid:%s, host:%s, port:%d",
+		conn.RemoteAddr(), t.account, t.uuid, t.host, t.port)
+
+	xreq.loopMsg()
+}
+
+// socksHandshake negotiate and authenticate, read connect request,
+// reply failure to client if any
+func socksHandshake(conn net.Conn) (*proxyTarget, error) {
+	// version, methods
+	buf := make([]byte, 2)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if buf[0] != socksVersion {
+		return nil, fmt.Errorf("unsupported socks version:%d", buf[0])
+	}
+
+	methods := make([]byte, buf[1])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return nil, err
+	}
+
+	// token is required, so only password method is accepted
+	method := byte(socksAuthNoAcceptable)
+	for _, m := range methods {
+		if m == socksAuthPassword {
+			method = socksAuthPassword
+		}
+	}
+
+	_, err = conn.Write([]byte{socksVersion, method})
+	if err != nil {
+		return nil, err
+	}
+
+	if method == socksAuthNoAcceptable {
+		return nil, fmt.Errorf("no acceptable auth method")
+	}
+
+	user, password, err := socksReadPassword(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	account, ok := server.VerifyClientTK(password)
+	status := byte(socksPasswordAuthSucceeded)
+	if !ok {
+		status = socksPasswordAuthFailed
+	}
+
+	_, err = conn.Write([]byte{socksPasswordAuthVersion, status})
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("invalid client token")
+	}
+
+	// version, cmd, reserved, address type
+	header := make([]byte, 4)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if header[0] != socksVersion {
+		return nil, fmt.Errorf("unsupported socks version:%d", header[0])
+	}
+
+	host, port, err := socksReadAddr(conn, header[3])
+	if err != nil {
+		socksReply(conn, socksRepAtypNotSupported)
+		return nil, err
+	}
+
+	if header[1] != socksCmdConnect {
+		socksReply(conn, socksRepCmdNotSupported)
+		return nil, fmt.Errorf("unsupported socks cmd:%d", header[1])
+	}
+
+	t, code, reason := resolveProxyTarget(account, user, host, port)
+	if code != http.StatusOK {
+		rep := byte(socksRepGeneralFailure)
+		switch code {
+		case http.StatusForbidden:
+			rep = socksRepNotAllowed
+		case http.StatusNotFound:
+			rep = socksRepHostUnreachable
+		}
+
+		socksReply(conn, rep)
+		return nil, fmt.Errorf("%s %s", socksAddr(host, port), reason)
+	}
+
+	return t, nil
+}
+
+// socksReadPassword read username/password request
+func socksReadPassword(conn net.Conn) (string, string, error) {
+	buf := make([]byte, 2)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return "", "", err
+	}
+
+	if buf[0] != socksPasswordAuthVersion {
+		return "", "", fmt.Errorf("unsupported password auth version:%d", buf[0])
+	}
+
+	user := make([]byte, buf[1])
+	_, err = io.ReadFull(conn, user)
+	if err != nil {
+		return "", "", err
+	}
+
+	_, err = io.ReadFull(conn, buf[:1])
+	if err != nil {
+		return "", "", err
+	}
+
+	password := make([]byte, buf[0])
+	_, err = io.ReadFull(conn, password)
+	if err != nil {
+		return "", "", err
+	}
+
+	return string(user), string(password), nil
+}
+
+func socksReadAddr(conn net.Conn, atyp byte) (string, int, error) {
+	var host string
+	switch atyp {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make([]byte, net.IPv4len)
+		if atyp == socksAtypIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+
+		_, err := io.ReadFull(conn, ip)
+		if err != nil {
+			return "", 0, err
+		}
+
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		l := make([]byte, 1)
+		_, err := io.ReadFull(conn, l)
+		if err != nil {
+			return "", 0, err
+		}
+
+		domain := make([]byte, l[0])
+		_, err = io.ReadFull(conn, domain)
+		if err != nil {
+			return "", 0, err
+		}
+
+		host = string(domain)
+	default:
+		return "", 0, fmt.Errorf("unsupported socks address type:%d", atyp)
+	}
+
+	port := make([]byte, 2)
+	_, err := io.ReadFull(conn, port)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return host, int(binary.BigEndian.Uint16(port)), nil
+}
+
+func socksReply(conn net.Conn, rep byte) error {
+	_, err := conn.Write(socksReplyMsg(rep))
+	return err
+}
+
+// socksReplyMsg bound address is meaningless for xport, zero is replied
+func socksReplyMsg(rep byte) []byte {
+	return []byte{socksVersion, rep, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0}
+}
+
+// socksAddr format destination for log
+func socksAddr(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
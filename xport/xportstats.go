@@ -0,0 +1,127 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DeviceStats traffic counters of a device, bytes are counted in device's view:
+// BytesSent is device to clients, BytesRecv is clients to device
+type DeviceStats struct {
+	UUID        string    `json:"uuid"`
+	ConnectedAt time.Time `json:"connected_at"`
+	BytesSent   uint64    `json:"bytes_sent"`
+	BytesRecv   uint64    `json:"bytes_recv"`
+
+	// Sessions total requests count since connected
+	Sessions       uint64 `json:"sessions"`
+	ActiveSessions int    `json:"active_sessions"`
+	// SessionsDuration total duration of closed requests
+	SessionsDuration time.Duration `json:"sessions_duration"`
+}
+
+// RequestStats traffic counters of a request, in device's view
+type RequestStats struct {
+	Idx        uint16        `json:"idx"`
+	Tag        uint16        `json:"tag"`
+	Host       string        `json:"host,omitempty"`
+	Port       uint16        `json:"port"`
+	Dgram      bool          `json:"dgram"`
+	ClientAddr string        `json:"client_addr"`
+	CreatedAt  time.Time     `json:"created_at"`
+	Duration   time.Duration `json:"duration"`
+	BytesSent  uint64        `json:"bytes_sent"`
+	BytesRecv  uint64        `json:"bytes_recv"`
+}
+
+// trafficCounter bytes counter shared by device and request
+type trafficCounter struct {
+	bytesSent uint64
+	bytesRecv uint64
+}
+
+func (tc *trafficCounter) addSent(n int) {
+	atomic.AddUint64(&tc.bytesSent, uint64(n))
+}
+
+func (tc *trafficCounter) addRecv(n int) {
+	atomic.AddUint64(&tc.bytesRecv, uint64(n))
+}
+
+func (tc *trafficCounter) reset() {
+	atomic.StoreUint64(&tc.bytesSent, 0)
+	atomic.StoreUint64(&tc.bytesRecv, 0)
+}
+
+// Stats snapshot of device traffic counters
+func (d *XDevice) Stats() *DeviceStats {
+	active := 0
+	for _, r := range d.allRequests() {
+		if r.isUsed() {
+			active++
+		}
+	}
+
+	return &DeviceStats{
+		UUID:             d.uuid,
+		ConnectedAt:      d.connectedAt,
+		BytesSent:        atomic.LoadUint64(&d.traffic.bytesSent),
+		BytesRecv:        atomic.LoadUint64(&d.traffic.bytesRecv),
+		Sessions:         atomic.LoadUint64(&d.sessions),
+		ActiveSessions:   active,
+		SessionsDuration: time.Duration(atomic.LoadInt64(&d.sessionsDuration)),
+	}
+}
+
+// RequestStats snapshot of traffic counters of all active requests
+func (d *XDevice) RequestStats() []*RequestStats {
+	list := make([]*RequestStats, 0)
+	for _, r := range d.allRequests() {
+		st := r.stats()
+		if st != nil {
+			list = append(list, st)
+		}
+	}
+
+	return list
+}
+
+// stats snapshot of current use, nil if request is not in use
+func (r *XRequest) stats() *RequestStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.inUsed {
+		return nil
+	}
+
+	clientAddr := ""
+	if r.conn != nil {
+		clientAddr = r.conn.remoteAddr().String()
+	}
+
+	return &RequestStats{
+		ClientAddr: clientAddr,
+		Idx:        r.idx,
+		Tag:        r.tag,
+		Host:       r.host,
+		Port:       r.port,
+		Dgram:      r.dgram,
+		CreatedAt:  r.createdAt,
+		Duration:   time.Since(r.createdAt),
+		BytesSent:  atomic.LoadUint64(&r.traffic.bytesSent),
+		BytesRecv:  atomic.LoadUint64(&r.traffic.bytesRecv),
+	}
+}
+
+// onSent count bytes that device sent to client
+func (r *XRequest) onSent(n int) {
+	r.traffic.addSent(n)
+	r.dev.traffic.addSent(n)
+}
+
+// onRecv count bytes that device received from client
+func (r *XRequest) onRecv(n int) {
+	r.traffic.addRecv(n)
+	r.dev.traffic.addRecv(n)
+}
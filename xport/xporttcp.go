@@ -0,0 +1,246 @@
+package server
+
+import (
+	"fmt"
+	"lproxy/server"
+	"lproxy/servercfg"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TCPMapping a device port exposed as server-side tcp listener,
+// or a port of Host on device's LAN
+type TCPMapping struct {
+	Listen string `json:"listen"`
+	UUID   string `json:"uuid"`
+	Host   string `json:"host,omitempty"`
+	Port   uint16 `json:"port"`
+
+	// Persistent mapping comes from config, it listens again when device back online
+	Persistent bool `json:"persistent"`
+	// Active whether the listener is opened
+	Active bool `json:"active"`
+}
+
+type tcpMapping struct {
+	listen     string
+	uuid       string
+	host       string
+	port       uint16
+	persistent bool
+
+	listener net.Listener
+}
+
+type tcpMapper struct {
+	mutex    sync.Mutex
+	mappings map[string]*tcpMapping
+}
+
+var (
+	tcpMappings = &tcpMapper{mappings: make(map[string]*tcpMapping)}
+)
+
+// AddTCPMapping expose a port of online device as server-side tcp listener,
+// the mapping will be removed when device goes offline
+func AddTCPMapping(listen string, uuid string, port uint16) error {
+	return tcpMappings.add(listen, uuid, "", port, false)
+}
+
+// AddTCPHostMapping like AddTCPMapping, but the target is a host on device's LAN
+func AddTCPHostMapping(listen string, uuid string, host string, port uint16) error {
+	return tcpMappings.add(listen, uuid, host, port, false)
+}
+
+// RemoveTCPMapping close listener and remove the mapping
+func RemoveTCPMapping(listen string) error {
+	return tcpMappings.remove(listen)
+}
+
+// ListTCPMappings snapshot of all tcp mappings
+func ListTCPMappings() []*TCPMapping {
+	return tcpMappings.list()
+}
+
+func (tm *tcpMapper) add(listen string, uuid string, host string, port uint16, persistent bool) error {
+	var err error
+	if host != "" {
+		err = checkLANPolicy(uuid, host, int(port))
+	} else {
+		err = checkPolicy(uuid, int(port))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	_, ok := tm.mappings[listen]
+	if ok {
+		return fmt.Errorf("tcp mapping for %s already exist", listen)
+	}
+
+	m := &tcpMapping{
+		listen:     listen,
+		uuid:       uuid,
+		host:       host,
+		port:       port,
+		persistent: persistent,
+	}
+
+	if devices.Get(uuid) != nil {
+		err = m.start()
+		if err != nil {
+			return err
+		}
+	} else if !persistent {
+		return fmt.Errorf("no dev found for uuid:%s", uuid)
+	}
+
+	tm.mappings[listen] = m
+	return nil
+}
+
+func (tm *tcpMapper) remove(listen string) error {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	m, ok := tm.mappings[listen]
+	if !ok {
+		return fmt.Errorf("no tcp mapping for %s", listen)
+	}
+
+	m.stop()
+	delete(tm.mappings, listen)
+	return nil
+}
+
+func (tm *tcpMapper) list() []*TCPMapping {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	list := make([]*TCPMapping, 0, len(tm.mappings))
+	for _, m := range tm.mappings {
+		list = append(list, &TCPMapping{
+			Listen:     m.listen,
+			UUID:       m.uuid,
+			Host:       m.host,
+			Port:       m.port,
+			Persistent: m.persistent,
+			Active:     m.listener != nil,
+		})
+	}
+
+	return list
+}
+
+func (tm *tcpMapper) onDeviceEvent(ev *DeviceEvent) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	for listen, m := range tm.mappings {
+		if m.uuid != ev.UUID {
+			continue
+		}
+
+		switch ev.Type {
+		case DeviceOnline:
+			err := m.start()
+			if err != nil {
+				log.Printf("tcp mapping %s listen failed:%v", listen, err)
+			}
+		case DeviceOffline:
+			m.stop()
+			if !m.persistent {
+				delete(tm.mappings, listen)
+			}
+		}
+	}
+}
+
+func (m *tcpMapping) start() error {
+	if m.listener != nil {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", m.listen)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("tcp mapping listen at:%s, uuid:%s, host:%s, port:%d", m.listen, m.uuid, m.host, m.port)
+	m.listener = ln
+	go m.serve(ln)
+
+	return nil
+}
+
+func (m *tcpMapping) stop() {
+	if m.listener == nil {
+		return
+	}
+
+	log.Printf("tcp mapping stop:%s, uuid:%s", m.listen, m.uuid)
+	m.listener.Close()
+	m.listener = nil
+}
+
+func (m *tcpMapping) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+
+			log.Printf("tcp mapping %s accept end:%v", m.listen, err)
+			return
+		}
+
+		go m.serveConn(conn)
+	}
+}
+
+func (m *tcpMapping) serveConn(conn net.Conn) {
+	log.Println("tcp mapping accept from:", conn.RemoteAddr())
+
+	xdev := devices.Get(m.uuid)
+	if xdev == nil {
+		log.Println("no dev found for uuid:", m.uuid)
+		conn.Close()
+		return
+	}
+
+	xreq, err := xdev.mountRequest(m.uuid, m.host, m.port, newTCPClient(conn), false)
+	if err != nil {
+		log.Println("failed to mount request into xdev:", err)
+		conn.Close()
+		return
+	}
+
+	xreq.loopMsg()
+}
+
+func init() {
+	server.InvokeAfterCfgLoaded(func() {
+		devices.Subscribe(tcpMappings.onDeviceEvent)
+
+		for _, cfg := range servercfg.XPortTCPMaps {
+			if cfg.Port <= 0 || cfg.Port > 65535 {
+				log.Printf("tcp mapping %s invalid port:%d", cfg.Listen, cfg.Port)
+				continue
+			}
+
+			err := tcpMappings.add(cfg.Listen, cfg.UUID, cfg.Host, uint16(cfg.Port), true)
+			if err != nil {
+				log.Printf("tcp mapping %s add failed:%v", cfg.Listen, err)
+			}
+		}
+	})
+}
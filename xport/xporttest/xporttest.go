@@ -0,0 +1,64 @@
+// Package xporttest serves xport on an in-memory listener for tests of the
+// packages built on it, such as the device agent and admin api
+package xporttest
+
+import (
+	"encoding/json"
+	"lproxy/server"
+	"lproxy/servercfg"
+	"lproxy/xport/lws"
+	"net"
+	"net/http/httptest"
+	"sync"
+)
+
+var (
+	serverOnce sync.Once
+	testServer *httptest.Server
+	testPipe   *lws.PipeListener
+)
+
+// StartServer serve all registered handlers and a fake auth handler on
+// in-memory listener, handlers are global so it is shared by all tests of a
+// package, setup of the first call may change config before it is loaded
+func StartServer(setup func()) (*httptest.Server, *lws.PipeListener) {
+	serverOnce.Do(func() {
+		server.InvokeAfterCfgLoaded(func() {
+			server.RegisterPostHandleNoUUID(servercfg.AuthPath, func(ctx *server.RequestContext) {
+				req := struct {
+					UUID string `json:"uuid"`
+				}{}
+				json.Unmarshal(ctx.Body, &req)
+
+				// in the shape of agent.CfgResult
+				b, _ := json.Marshal(map[string]string{"token": server.GenTK(req.UUID)})
+				ctx.W.Write(b)
+			})
+		})
+
+		if setup != nil {
+			setup()
+		}
+
+		server.OnCfgLoaded()
+
+		testPipe = lws.ListenPipe()
+		testServer = httptest.NewUnstartedServer(server.GetHTTPHandler())
+		testServer.Listener.Close()
+		testServer.Listener = testPipe
+		testServer.Start()
+	})
+
+	return testServer, testPipe
+}
+
+// FreeAddr a free local tcp address
+func FreeAddr() string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+
+	defer ln.Close()
+	return ln.Addr().String()
+}
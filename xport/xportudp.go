@@ -0,0 +1,364 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"lproxy/server"
+	"lproxy/servercfg"
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	udpSessionQueueSize = 64
+)
+
+// udpClient a session of udp mapping, identified by peer address
+type udpClient struct {
+	pc      net.PacketConn
+	addr    net.Addr
+	ch      chan []byte
+	closeCh chan struct{}
+	once    sync.Once
+	onClose func()
+}
+
+func newUDPClient(pc net.PacketConn, addr net.Addr, onClose func()) *udpClient {
+	return &udpClient{
+		pc:      pc,
+		addr:    addr,
+		ch:      make(chan []byte, udpSessionQueueSize),
+		closeCh: make(chan struct{}),
+		onClose: onClose,
+	}
+}
+
+// push enqueue a datagram from peer, drop it if queue is full
+func (c *udpClient) push(message []byte) {
+	select {
+	case c.ch <- message:
+	case <-c.closeCh:
+	default:
+		log.Println("udp session queue full, drop datagram from:", c.addr)
+	}
+}
+
+func (c *udpClient) readMessage() ([]byte, error) {
+	select {
+	case m := <-c.ch:
+		return m, nil
+	case <-c.closeCh:
+		return nil, io.EOF
+	}
+}
+
+func (c *udpClient) writeMessage(data []byte) error {
+	_, err := c.pc.WriteTo(data, c.addr)
+	return err
+}
+
+func (c *udpClient) closeWrite() error {
+	return nil
+}
+
+func (c *udpClient) close() error {
+	c.once.Do(func() {
+		close(c.closeCh)
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+
+	return nil
+}
+
+func (c *udpClient) remoteAddr() net.Addr {
+	return c.addr
+}
+
+// UDPMapping a device udp port exposed as server-side udp socket,
+// or a udp port of Host on device's LAN
+type UDPMapping struct {
+	Listen string `json:"listen"`
+	UUID   string `json:"uuid"`
+	Host   string `json:"host,omitempty"`
+	Port   uint16 `json:"port"`
+
+	// Persistent mapping comes from config, it listens again when device back online
+	Persistent bool `json:"persistent"`
+	// Active whether the socket is opened
+	Active bool `json:"active"`
+	// Sessions current peers count
+	Sessions int `json:"sessions"`
+}
+
+type udpMapping struct {
+	listen     string
+	uuid       string
+	host       string
+	port       uint16
+	persistent bool
+
+	pc           net.PacketConn
+	sessionMutex sync.Mutex
+	sessions     map[string]*udpClient
+}
+
+type udpMapper struct {
+	mutex    sync.Mutex
+	mappings map[string]*udpMapping
+}
+
+var (
+	udpMappings = &udpMapper{mappings: make(map[string]*udpMapping)}
+)
+
+// AddUDPMapping expose a udp port of online device as server-side udp socket,
+// the mapping will be removed when device goes offline
+func AddUDPMapping(listen string, uuid string, port uint16) error {
+	return udpMappings.add(listen, uuid, "", port, false)
+}
+
+// AddUDPHostMapping like AddUDPMapping, but the target is a host on device's LAN
+func AddUDPHostMapping(listen string, uuid string, host string, port uint16) error {
+	return udpMappings.add(listen, uuid, host, port, false)
+}
+
+// RemoveUDPMapping close socket and remove the mapping
+func RemoveUDPMapping(listen string) error {
+	return udpMappings.remove(listen)
+}
+
+// ListUDPMappings snapshot of all udp mappings
+func ListUDPMappings() []*UDPMapping {
+	return udpMappings.list()
+}
+
+func (um *udpMapper) add(listen string, uuid string, host string, port uint16, persistent bool) error {
+	var err error
+	if host != "" {
+		err = checkLANPolicy(uuid, host, int(port))
+	} else {
+		err = checkPolicy(uuid, int(port))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	um.mutex.Lock()
+	defer um.mutex.Unlock()
+
+	_, ok := um.mappings[listen]
+	if ok {
+		return fmt.Errorf("udp mapping for %s already exist", listen)
+	}
+
+	m := &udpMapping{
+		listen:     listen,
+		uuid:       uuid,
+		host:       host,
+		port:       port,
+		persistent: persistent,
+		sessions:   make(map[string]*udpClient),
+	}
+
+	if devices.Get(uuid) != nil {
+		err = m.start()
+		if err != nil {
+			return err
+		}
+	} else if !persistent {
+		return fmt.Errorf("no dev found for uuid:%s", uuid)
+	}
+
+	um.mappings[listen] = m
+	return nil
+}
+
+func (um *udpMapper) remove(listen string) error {
+	um.mutex.Lock()
+	defer um.mutex.Unlock()
+
+	m, ok := um.mappings[listen]
+	if !ok {
+		return fmt.Errorf("no udp mapping for %s", listen)
+	}
+
+	m.stop()
+	delete(um.mappings, listen)
+	return nil
+}
+
+func (um *udpMapper) list() []*UDPMapping {
+	um.mutex.Lock()
+	defer um.mutex.Unlock()
+
+	list := make([]*UDPMapping, 0, len(um.mappings))
+	for _, m := range um.mappings {
+		m.sessionMutex.Lock()
+		sessions := len(m.sessions)
+		m.sessionMutex.Unlock()
+
+		list = append(list, &UDPMapping{
+			Listen:     m.listen,
+			UUID:       m.uuid,
+			Host:       m.host,
+			Port:       m.port,
+			Persistent: m.persistent,
+			Active:     m.pc != nil,
+			Sessions:   sessions,
+		})
+	}
+
+	return list
+}
+
+func (um *udpMapper) onDeviceEvent(ev *DeviceEvent) {
+	um.mutex.Lock()
+	defer um.mutex.Unlock()
+
+	for listen, m := range um.mappings {
+		if m.uuid != ev.UUID {
+			continue
+		}
+
+		switch ev.Type {
+		case DeviceOnline:
+			err := m.start()
+			if err != nil {
+				log.Printf("udp mapping %s listen failed:%v", listen, err)
+			}
+		case DeviceOffline:
+			m.stop()
+			if !m.persistent {
+				delete(um.mappings, listen)
+			}
+		}
+	}
+}
+
+func (m *udpMapping) start() error {
+	if m.pc != nil {
+		return nil
+	}
+
+	pc, err := net.ListenPacket("udp", m.listen)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("udp mapping listen at:%s, uuid:%s, host:%s, port:%d", m.listen, m.uuid, m.host, m.port)
+	m.pc = pc
+	go m.serve(pc)
+
+	return nil
+}
+
+func (m *udpMapping) stop() {
+	if m.pc == nil {
+		return
+	}
+
+	log.Printf("udp mapping stop:%s, uuid:%s", m.listen, m.uuid)
+	m.pc.Close()
+	m.pc = nil
+}
+
+func (m *udpMapping) serve(pc net.PacketConn) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+
+			log.Printf("udp mapping %s read end:%v", m.listen, err)
+			break
+		}
+
+		c := m.getSession(pc, addr)
+		if c == nil {
+			continue
+		}
+
+		message := make([]byte, n)
+		copy(message, buf[:n])
+		c.push(message)
+	}
+
+	// close all sessions
+	m.sessionMutex.Lock()
+	sessions := make([]*udpClient, 0, len(m.sessions))
+	for _, c := range m.sessions {
+		sessions = append(sessions, c)
+	}
+	m.sessionMutex.Unlock()
+
+	for _, c := range sessions {
+		c.close()
+	}
+}
+
+// getSession get or create the session for peer address
+func (m *udpMapping) getSession(pc net.PacketConn, addr net.Addr) *udpClient {
+	key := addr.String()
+
+	m.sessionMutex.Lock()
+	c, ok := m.sessions[key]
+	m.sessionMutex.Unlock()
+
+	if ok {
+		return c
+	}
+
+	xdev := devices.Get(m.uuid)
+	if xdev == nil {
+		log.Println("no dev found for uuid:", m.uuid)
+		return nil
+	}
+
+	c = newUDPClient(pc, addr, func() {
+		m.sessionMutex.Lock()
+		if m.sessions[key] == c {
+			delete(m.sessions, key)
+		}
+		m.sessionMutex.Unlock()
+	})
+
+	xreq, err := xdev.mountRequest(m.uuid, m.host, m.port, c, true)
+	if err != nil {
+		log.Println("failed to mount request into xdev:", err)
+		return nil
+	}
+
+	log.Println("udp mapping new session from:", addr)
+	m.sessionMutex.Lock()
+	m.sessions[key] = c
+	m.sessionMutex.Unlock()
+
+	go xreq.loopMsg()
+
+	return c
+}
+
+func init() {
+	server.InvokeAfterCfgLoaded(func() {
+		devices.Subscribe(udpMappings.onDeviceEvent)
+
+		for _, cfg := range servercfg.XPortUDPMaps {
+			if cfg.Port <= 0 || cfg.Port > 65535 {
+				log.Printf("udp mapping %s invalid port:%d", cfg.Listen, cfg.Port)
+				continue
+			}
+
+			err := udpMappings.add(cfg.Listen, cfg.UUID, cfg.Host, uint16(cfg.Port), true)
+			if err != nil {
+				log.Printf("udp mapping %s add failed:%v", cfg.Listen, err)
+			}
+		}
+	})
+}